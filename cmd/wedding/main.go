@@ -8,8 +8,10 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -20,6 +22,7 @@ import (
 	"github.com/urfave/cli/v2"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 var (
@@ -38,12 +41,26 @@ func main() {
 				Usage: "Start the server.",
 				Flags: []cli.Flag{
 					&cli.StringFlag{Name: "addr", Value: ":2375", Usage: "Address to run service on."},
-					&cli.StringFlag{Name: "s3-endpoint", Required: true, Usage: "s3 endpoint."},
-					&cli.StringFlag{Name: "s3-access-key-file", Required: true, Usage: "Path to s3 access key."},
-					&cli.StringFlag{Name: "s3-secret-key-file", Required: true, Usage: "Path to s3 secret access key."},
+					&cli.StringFlag{Name: "config", Usage: "Path to a YAML or JSON config file, reloaded on SIGHUP."},
+					&cli.StringFlag{Name: "s3-endpoint", Usage: "s3 endpoint, build contexts are served by wedding without it."},
+					&cli.StringFlag{Name: "s3-access-key-file", Usage: "Path to s3 access key."},
+					&cli.StringFlag{Name: "s3-secret-key-file", Usage: "Path to s3 secret access key."},
 					&cli.BoolFlag{Name: "s3-ssl", Value: true, Usage: "s3 uses SSL."},
 					&cli.StringFlag{Name: "s3-location", Value: "us-east-1", Usage: "s3 bucket location."},
-					&cli.StringFlag{Name: "s3-bucket", Required: true, Usage: "s3 bucket name."},
+					&cli.StringFlag{Name: "s3-bucket", Usage: "s3 bucket name."},
+					&cli.StringFlag{Name: "context-url", Usage: "URL build pods reach wedding at to download build contexts, required without s3."},
+					&cli.StringFlag{Name: "context-dir", Value: filepath.Join(os.TempDir(), "wedding"), Usage: "Directory build contexts are kept in without s3."},
+					&cli.IntFlag{Name: "backoff-limit", Value: 0, Usage: "Number of retries of failed jobs."},
+					&cli.DurationFlag{Name: "job-ttl", Value: 10 * time.Minute, Usage: "Time finished jobs are kept before kubernetes deletes them."},
+					&cli.DurationFlag{Name: "gc-interval", Value: 5 * time.Minute, Usage: "Interval of the garbage collection of orphaned jobs, pods, secrets and contexts."},
+					&cli.DurationFlag{Name: "gc-ttl", Value: time.Hour, Usage: "Age after which orphaned jobs, pods and secrets are removed, including failed jobs kept by KEEP_FAILED_PODS."},
+					&cli.StringFlag{Name: "build-pod-template", Usage: "PodTemplate file or podtemplate/NAME merged into build pods."},
+					&cli.StringFlag{Name: "skopeo-pod-template", Usage: "PodTemplate file or podtemplate/NAME merged into skopeo pods."},
+					&cli.StringFlag{Name: "kubeconfig", Usage: "Path to a kubeconfig file to run outside of the cluster."},
+					&cli.StringFlag{Name: "context", Usage: "Kubeconfig context to use instead of the current context."},
+					&cli.StringFlag{Name: "namespace", Usage: "Namespace to run jobs in, defaults to the namespace of the service account or the kubeconfig context."},
+					&cli.StringFlag{Name: "targets", Usage: "Path to a YAML or JSON file listing the clusters and namespaces to run jobs in, replaces kubeconfig, context and namespace."},
+					&cli.StringFlag{Name: "copy-engine", Value: wedding.CopyEngineInProcess, Usage: "Copy images for pull and push in-process or with skopeo pods."},
 				},
 				Action: run,
 			},
@@ -73,29 +90,75 @@ func run(c *cli.Context) error {
 	log.Printf("version: %v", gitRef)
 	log.Printf("git commit: %v", gitHash)
 
+	log.Println("load config")
+
+	cfg, err := wedding.LoadConfig(c.String("config"))
+	if err != nil {
+		return fmt.Errorf("load config: %v", err)
+	}
+
 	log.Println("set up storage")
 
-	storage, err := setupObjectStore(
-		c.String("s3-endpoint"),
-		c.String("s3-access-key-file"),
-		c.String("s3-secret-key-file"),
-		c.Bool("s3-ssl"),
-		c.String("s3-location"),
-		c.String("s3-bucket"))
+	storage, err := setupContextStore(c)
 	if err != nil {
-		return fmt.Errorf("setup minio s3 client: %v", err)
+		return err
 	}
 
-	log.Println("set up kubernetes client")
+	log.Println("set up kubernetes clients")
 
-	kubernetesClient, namespace, err := setupKubernetesClient()
+	targets, err := setupTargets(c.String("targets"), c.String("kubeconfig"), c.String("context"), c.String("namespace"))
 	if err != nil {
-		return fmt.Errorf("setup kubernetes client: %v", err)
+		return err
+	}
+
+	copyEngine := c.String("copy-engine")
+	if copyEngine != wedding.CopyEngineInProcess && copyEngine != wedding.CopyEngineSkopeo {
+		return fmt.Errorf("unknown copy engine %s", copyEngine)
+	}
+
+	if c.Duration("gc-interval") <= 0 {
+		return fmt.Errorf("gc-interval must be positive")
+	}
+
+	if c.Duration("gc-ttl") < cfg.LongestTimeout() {
+		return fmt.Errorf("gc-ttl must not be shorter than the maximum execution time %v", cfg.LongestTimeout())
+	}
+
+	podTemplates := wedding.PodTemplates{}
+	for jobType, flag := range map[string]string{"buildkit": "build-pod-template", "skopeo": "skopeo-pod-template"} {
+		if c.String(flag) == "" {
+			continue
+		}
+
+		podTemplates[jobType], err = wedding.NewPodTemplateSource(c.String(flag))
+		if err != nil {
+			return fmt.Errorf("%s: %v", flag, err)
+		}
 	}
 
 	log.Println("set up service")
 
-	svc := wedding.NewService(gitHash, gitRef, storage, kubernetesClient, namespace)
+	svc := wedding.NewService(
+		gitHash,
+		gitRef,
+		cfg,
+		storage,
+		targets,
+		copyEngine,
+		int32(c.Int("backoff-limit")),
+		c.Duration("job-ttl"),
+		podTemplates,
+	)
+	defer svc.Close()
+
+	err = ensureBuildkitdPool(svc)
+	if err != nil {
+		return err
+	}
+
+	go svc.CollectGarbage(c.Duration("gc-interval"), c.Duration("gc-ttl"))
+
+	go reloadOnHangup(svc, c.String("config"), c.Duration("gc-ttl"))
 
 	svcServer := httpServer(svc, c.String("addr"))
 
@@ -107,7 +170,7 @@ func run(c *cli.Context) error {
 
 	awaitShutdown()
 
-	ctx, cancel := context.WithTimeout(context.Background(), wedding.MaxExecutionTime)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.LongestTimeout())
 	defer cancel()
 
 	err = shutdown(ctx, svcServer)
@@ -120,6 +183,45 @@ func run(c *cli.Context) error {
 	return nil
 }
 
+// setupContextStore uses the s3 bucket if configured,
+// otherwise wedding serves the build contexts itself.
+func setupContextStore(c *cli.Context) (wedding.ContextStore, error) {
+	if c.String("s3-endpoint") == "" {
+		if c.String("context-url") == "" {
+			return nil, fmt.Errorf("context-url is required without s3-endpoint")
+		}
+
+		log.Printf("serve build contexts at %s", c.String("context-url"))
+
+		// every retry of a job starts a new pod downloading the context
+		contexts, err := wedding.NewLocalContexts(c.String("context-dir"), c.String("context-url"), c.Int("backoff-limit")+1)
+		if err != nil {
+			return nil, err
+		}
+
+		return contexts, nil
+	}
+
+	for _, flag := range []string{"s3-access-key-file", "s3-secret-key-file", "s3-bucket"} {
+		if c.String(flag) == "" {
+			return nil, fmt.Errorf("%s is required with s3-endpoint", flag)
+		}
+	}
+
+	storage, err := setupObjectStore(
+		c.String("s3-endpoint"),
+		c.String("s3-access-key-file"),
+		c.String("s3-secret-key-file"),
+		c.Bool("s3-ssl"),
+		c.String("s3-location"),
+		c.String("s3-bucket"))
+	if err != nil {
+		return nil, fmt.Errorf("setup minio s3 client: %v", err)
+	}
+
+	return storage, nil
+}
+
 func setupObjectStore(
 	endpoint, accessKeyPath, secretKeyPath string,
 	useSSL bool,
@@ -165,29 +267,105 @@ func setupObjectStore(
 	}, nil
 }
 
-func setupKubernetesClient() (*kubernetes.Clientset, string, error) {
-	ns, err := ioutil.ReadFile("/run/secrets/kubernetes.io/serviceaccount/namespace")
-	if err != nil {
-		return nil, "", fmt.Errorf("read namespace: %v", err)
+// setupTargets creates a client for each target of the targets file.
+// Without a file jobs run on a single target configured by the flags.
+func setupTargets(path, kubeconfig, kubeContext, namespace string) ([]wedding.Target, error) {
+	targets := []wedding.Target{
+		{
+			Name:       "default",
+			Kubeconfig: kubeconfig,
+			Context:    kubeContext,
+			Namespace:  namespace,
+		},
 	}
 
-	config, err := rest.InClusterConfig()
+	if path != "" {
+		var err error
+		targets, err = wedding.LoadTargets(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for idx, target := range targets {
+		client, ns, err := setupKubernetesClient(target.Kubeconfig, target.Context, target.Namespace)
+		if err != nil {
+			return nil, fmt.Errorf("setup kubernetes client for target %s: %v", target.Name, err)
+		}
+
+		targets[idx].Client = client
+		targets[idx].Namespace = ns
+	}
+
+	return targets, nil
+}
+
+// setupKubernetesClient uses the service account when running in a cluster.
+// Outside of a cluster, or with an explicit kubeconfig or context, the kubeconfig
+// is loaded like kubectl does, from the path, $KUBECONFIG or ~/.kube/config.
+func setupKubernetesClient(kubeconfig, kubeContext, namespace string) (*kubernetes.Clientset, string, error) {
+	config, ns, err := inClusterConfig()
+	if kubeconfig != "" || kubeContext != "" || err == rest.ErrNotInCluster {
+		config, ns, err = kubeconfigConfig(kubeconfig, kubeContext)
+	}
 	if err != nil {
 		return nil, "", err
 	}
 
+	if namespace != "" {
+		ns = namespace
+	}
+
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		return nil, "", err
 	}
 
-	return clientset, string(ns), nil
+	log.Printf("using kubernetes api %s in namespace %s", config.Host, ns)
+
+	return clientset, ns, nil
+}
+
+func inClusterConfig() (*rest.Config, string, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, "", err
+	}
+
+	ns, err := ioutil.ReadFile("/run/secrets/kubernetes.io/serviceaccount/namespace")
+	if err != nil {
+		return nil, "", fmt.Errorf("read namespace: %v", err)
+	}
+
+	return config, strings.TrimSpace(string(ns)), nil
+}
+
+func kubeconfigConfig(kubeconfig, kubeContext string) (*rest.Config, string, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: kubeContext}
+
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides)
+
+	config, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, "", fmt.Errorf("load kubeconfig: %v", err)
+	}
+
+	ns, _, err := clientConfig.Namespace()
+	if err != nil {
+		return nil, "", fmt.Errorf("read namespace from kubeconfig: %v", err)
+	}
+
+	return config, ns, nil
 }
 
+// httpServer limits only the request headers. Builds, pulls and pushes stream
+// their output while uploading, queueing and running, their operations time out themselves.
 func httpServer(h http.Handler, addr string) *http.Server {
 	httpServer := &http.Server{
-		ReadTimeout:  wedding.MaxExecutionTime,
-		WriteTimeout: wedding.MaxExecutionTime,
+		ReadHeaderTimeout: time.Minute,
 	}
 	httpServer.Addr = addr
 	httpServer.Handler = h
@@ -202,6 +380,45 @@ func mustListenAndServe(srv *http.Server) {
 	}
 }
 
+// reloadOnHangup reloads the config file on SIGHUP.
+// The timeouts of the http server keep the value they were started with.
+func reloadOnHangup(svc *wedding.Service, path string, gcTTL time.Duration) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	for range hangup {
+		cfg, err := wedding.LoadConfig(path)
+		if err != nil {
+			log.Printf("reload config: %v", err)
+			continue
+		}
+
+		if gcTTL < cfg.LongestTimeout() {
+			log.Printf("reload config: gc-ttl %v is shorter than the maximum execution time %v", gcTTL, cfg.LongestTimeout())
+			continue
+		}
+
+		svc.Reload(cfg)
+
+		err = ensureBuildkitdPool(svc)
+		if err != nil {
+			log.Printf("reload config: %v", err)
+		}
+	}
+}
+
+func ensureBuildkitdPool(svc *wedding.Service) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	err := svc.EnsureBuildkitdPool(ctx)
+	if err != nil {
+		return fmt.Errorf("set up buildkitd pool: %v", err)
+	}
+
+	return nil
+}
+
 func awaitShutdown() {
 	stop := make(chan os.Signal, 2)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -11,6 +12,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -22,7 +24,19 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+var (
+	platformPattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]+(/[a-zA-Z0-9_.-]+){0,2}$`)
+	vertexPattern   = regexp.MustCompile(`^#(\d+) (.+)$`)
+	stagePattern    = regexp.MustCompile(`^\[[^\]]*\] `)
+	exitCodePattern = regexp.MustCompile(`exit code: (\d+)`)
+
+	errNoImageID = errors.New("image id not found in build metadata")
+)
+
 const (
+	metadataMarker  = "wedding-metadata "
+	dockerCPUPeriod = 100_000 // 100ms is the default of docker
+
 	helpText = `
 wedding builds only support these arguments: context, tag, buildargs, cachefrom, cpuperiod, cpuquota, dockerfile, memory, labels, and target
 %s`
@@ -35,9 +49,23 @@ type buildConfig struct {
 	dockerfile      string
 	memoryBytes     int
 	target          string
+	platform        string
+	storage         resource.Quantity
 	tags            []string
 	registryAuth    dockerConfig
 	contextFilePath string
+	contextChunks   []string
+	operation       operation
+	cacheKey        string
+}
+
+// ContextStore keeps build contexts until the build pod downloaded them.
+// Contexts are stored in an ObjectStore or served by wedding from LocalContexts.
+type ContextStore interface {
+	storeContext(ctx context.Context, r io.Reader, cfg *buildConfig, inflight *inflight, chunkTTL time.Duration) error
+	presignContext(ctx context.Context, cfg *buildConfig, expiry time.Duration) (string, error)
+	deleteContext(ctx context.Context, cfg *buildConfig) error
+	collectGarbage(ctx context.Context, inflight *inflight, maxAge, chunkTTL time.Duration) (int, int, error)
 }
 
 // ObjectStore manages access to a S3 compatible file store.
@@ -48,24 +76,34 @@ type ObjectStore struct {
 }
 
 func (s Service) build(w http.ResponseWriter, r *http.Request) {
-	cfg, err := buildParameters(r)
+	cfg, err := buildParameters(r, s.config())
+	if err != nil {
+		printBuildHelpText(w, err)
+		return
+	}
+
+	cfg.operation, err = newOperation(buildOperation, r)
 	if err != nil {
 		printBuildHelpText(w, err)
 		return
 	}
 
+	key := r.Header.Get(buildKeyHeader)
+	if key != "" {
+		s.detachedBuild(w, r, cfg, key)
+		return
+	}
+
 	ctx := r.Context()
 
-	err = s.objectStore.storeContext(ctx, r.Body, cfg)
+	err = s.storeContext(ctx, r.Body, cfg)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(fmt.Sprintf("store context: %v", err)))
 		log.Printf("store context: %v", err)
 		return
 	}
-	defer func() {
-		s.objectStore.deleteContext(ctx, cfg)
-	}()
+	defer s.deleteContext(cfg)
 
 	err = s.executeBuild(ctx, cfg, w)
 	if err != nil {
@@ -74,7 +112,7 @@ func (s Service) build(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func buildParameters(r *http.Request) (*buildConfig, error) {
+func buildParameters(r *http.Request, defaults Config) (*buildConfig, error) {
 	cfg := &buildConfig{}
 
 	asserts := map[string]string{
@@ -140,19 +178,19 @@ func buildParameters(r *http.Request) (*buildConfig, error) {
 	if err != nil {
 		return cfg, fmt.Errorf("parse cpu quota to int: %v", err)
 	}
-	if cpuquota == 0 {
-		cpuquota = buildCPUQuota
-	}
 
 	cpuperiod, err := strconv.Atoi(r.URL.Query().Get("cpuperiod"))
 	if err != nil {
 		return cfg, fmt.Errorf("parse cpu period to int: %v", err)
 	}
 	if cpuperiod == 0 {
-		cpuperiod = buildCPUPeriod
+		cpuperiod = dockerCPUPeriod
 	}
 
 	cfg.cpuMilliseconds = int(1000 * float64(cpuquota) / float64(cpuperiod))
+	if cpuquota == 0 {
+		cfg.cpuMilliseconds = defaults.buildCPUMilliseconds()
+	}
 
 	// Dockerfile
 	cfg.dockerfile = r.URL.Query().Get("dockerfile")
@@ -162,21 +200,41 @@ func buildParameters(r *http.Request) (*buildConfig, error) {
 
 	// memory limit
 	memoryArg := r.URL.Query().Get("memory")
-	if memoryArg == "" || memoryArg == "0" {
-		memoryArg = buildMemory
+	cfg.memoryBytes = defaults.buildMemoryBytes()
+	if memoryArg != "" && memoryArg != "0" {
+		memory, err := strconv.Atoi(memoryArg)
+		if err != nil {
+			return cfg, fmt.Errorf("parse cpu quota to int: %v", err)
+		}
+		cfg.memoryBytes = memory
 	}
-	memory, err := strconv.Atoi(memoryArg)
+
+	// builds on the buildkitd pool run in the shared daemon, the limits of the pool apply
+	if defaults.BuildkitdPool.Replicas > 0 && (cpuquota != 0 || (memoryArg != "" && memoryArg != "0")) {
+		return cfg, fmt.Errorf("cpu quota and memory limits are not supported with the buildkitd pool")
+	}
+
+	// scratch volume size
+	cfg.storage, err = buildStorage(r, defaults)
 	if err != nil {
-		return cfg, fmt.Errorf("parse cpu quota to int: %v", err)
+		return cfg, err
 	}
-	cfg.memoryBytes = memory
 
 	// target
 	cfg.target = r.URL.Query().Get("target")
 
+	// platform, selects the target as well
+	cfg.platform = r.URL.Query().Get("platform")
+	if cfg.platform != "" && !platformPattern.MatchString(cfg.platform) {
+		return cfg, fmt.Errorf("unsupported platform '%s'", cfg.platform)
+	}
+
 	// image tag
 	cfg.tags = r.URL.Query()["t"]
 
+	// daemon of the buildkitd pool
+	cfg.cacheKey = buildCacheKey(r.Header.Get(cacheKeyHeader), cfg)
+
 	// registry authentitation
 	dockerCfg, err := xRegistryConfig(r.Header.Get("X-Registry-Config")).toDockerConfig()
 	if err != nil {
@@ -199,16 +257,11 @@ func printBuildHelpText(w http.ResponseWriter, err error) {
 	}
 }
 
-func (o ObjectStore) storeContext(ctx context.Context, r io.Reader, cfg *buildConfig) error {
-	path := fmt.Sprintf("%d.tar", time.Now().UnixNano())
-	cfg.contextFilePath = path
+// storeContext uploads the chunks of the build context missing in the bucket.
+func (o ObjectStore) storeContext(ctx context.Context, r io.Reader, cfg *buildConfig, inflight *inflight, chunkTTL time.Duration) error {
+	cfg.contextFilePath = fmt.Sprintf("%s%d", contextPrefix, time.Now().UnixNano())
 
-	_, err := o.Uploader.UploadWithContext(ctx, &s3manager.UploadInput{
-		Bucket:      aws.String(o.Bucket),
-		Key:         aws.String(path),
-		ContentType: aws.String("application/x-tar"),
-		Body:        r,
-	})
+	err := o.storeChunks(ctx, r, cfg, inflight, chunkTTL)
 	if err != nil {
 		return fmt.Errorf("upload build context to bucket: %v", err)
 	}
@@ -216,14 +269,19 @@ func (o ObjectStore) storeContext(ctx context.Context, r io.Reader, cfg *buildCo
 	return nil
 }
 
-func (o ObjectStore) presignContext(cfg *buildConfig) (string, error) {
+// presignContext stores the list of chunk urls of the context and returns its url.
+func (o ObjectStore) presignContext(ctx context.Context, cfg *buildConfig, expiry time.Duration) (string, error) {
+	err := o.storeChunkList(ctx, cfg, expiry)
+	if err != nil {
+		return "", err
+	}
 
 	objectRequest, _ := o.Client.GetObjectRequest(&s3.GetObjectInput{
 		Bucket: aws.String(o.Bucket),
 		Key:    aws.String(cfg.contextFilePath),
 	})
 
-	url, err := objectRequest.Presign(MaxExecutionTime)
+	url, err := objectRequest.Presign(expiry)
 	if err != nil {
 		return "", fmt.Errorf("presign GET %s: %v", cfg.contextFilePath, err)
 	}
@@ -231,60 +289,58 @@ func (o ObjectStore) presignContext(cfg *buildConfig) (string, error) {
 	return url, nil
 }
 
+// deleteContext deletes the chunk list and the manifest of the context,
+// the chunks are kept for later builds.
 func (o ObjectStore) deleteContext(ctx context.Context, cfg *buildConfig) error {
-	_, err := o.Client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
-		Bucket: aws.String(o.Bucket),
-		Key:    aws.String(cfg.contextFilePath),
-	})
-	if err != nil {
-		return err
+	for _, key := range []string{cfg.contextFilePath, manifestKey(cfg.contextFilePath)} {
+		_, err := o.Client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(o.Bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (s Service) executeBuild(ctx context.Context, cfg *buildConfig, w http.ResponseWriter) error {
-	presignedContextURL, err := s.objectStore.presignContext(cfg)
+func (s Service) executeBuild(ctx context.Context, cfg *buildConfig, w io.Writer) error {
+	o := &output{w: w}
+
+	release, err := enqueue(ctx, s.builds, cfg.operation, o)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	config := s.config()
+
+	timeout := config.timeout(cfg.operation)
+
+	presignedContextURL, err := s.contexts.presignContext(ctx, cfg, timeout)
 	if err != nil {
 		return err
 	}
 
 	secret := &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
-			GenerateName: "wedding-docker-config-",
+			Name: cfg.operation.secretName(),
 		},
 		StringData: map[string]string{
 			"config.json": cfg.registryAuth.mustToJSON(),
 		},
 	}
 
-	secretClient := s.kubernetesClient.CoreV1().Secrets(s.namespace)
-
-	secret, err = secretClient.Create(ctx, secret, metav1.CreateOptions{})
-	if err != nil {
-		streamf(w, "Secret creation failed: %v\n", err)
-		return fmt.Errorf("create secret: %v", err)
-	}
-	defer func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-
-		err = secretClient.Delete(ctx, secret.Name, metav1.DeleteOptions{})
-		if err != nil {
-			streamf(w, "Secret deletetion failed: %v\n", err)
-			log.Printf("delete secret: %v", err)
-		}
-	}()
-
 	imageNames := ""
 	for idx, tag := range cfg.tags {
 		if idx != 0 {
 			imageNames += ","
 		}
-		imageNames += fmt.Sprintf("wedding-registry:5000/images/%s", tag)
+		imageNames += fmt.Sprintf("%s/images/%s", config.Registry, tag)
 	}
 
-	destination := "--output type=image,push=true,name=wedding-registry:5000/digests"
+	destination := fmt.Sprintf("--output type=image,push=true,name=%s/digests", config.Registry)
 	if imageNames != "" {
 		destination = fmt.Sprintf(`--output type=image,push=true,\"name=%s\"`, imageNames)
 	}
@@ -297,6 +353,11 @@ func (s Service) executeBuild(ctx context.Context, cfg *buildConfig, w http.Resp
 		target = fmt.Sprintf("--opt target=%s", cfg.target)
 	}
 
+	platform := ""
+	if cfg.platform != "" {
+		platform = fmt.Sprintf("--opt platform=%s", cfg.platform)
+	}
+
 	buildargs := ""
 	for k, v := range cfg.buildArgs {
 		buildargs += fmt.Sprintf("--opt build-arg:%s='%s' ", k, v)
@@ -307,17 +368,38 @@ func (s Service) executeBuild(ctx context.Context, cfg *buildConfig, w http.Resp
 		buildargs += fmt.Sprintf("--opt label:%s='%s' ", k, v)
 	}
 
+	buildctl := "buildctl-daemonless.sh"
+	waitForDaemon := ""
+	cpu := resource.MustParse(fmt.Sprintf("%dm", cfg.cpuMilliseconds))
+	buildkitdMemory := resource.MustParse(config.BuildkitdMemory)
+	memory := *resource.NewQuantity(int64(cfg.memoryBytes)+buildkitdMemory.Value(), resource.BinarySI)
+
+	pool := config.BuildkitdPool
+	if pool.Replicas > 0 {
+		// the daemon runs the build, the pod only uploads the context
+		address := pool.address(cfg.cacheKey)
+		buildctl = fmt.Sprintf("buildctl --addr %s", address)
+		waitForDaemon = fmt.Sprintf(`
+echo wait for buildkitd %s
+until %s debug workers > /dev/null; do sleep 1; done
+`, address, buildctl)
+		cpu = resource.MustParse(pool.ClientCPU)
+		memory = resource.MustParse(pool.ClientMemory)
+	}
+
 	buildScript := fmt.Sprintf(`
 set -euo pipefail
 unset x
 
 echo download build context
-cd ~ && mkdir context && cd context
-wget -O - "${CONTEXT_URL}" | tar -xf -
-
+mkdir -p %s/context && cd %s/context
+wget -q -O /tmp/chunks "${CONTEXT_URL}"
+while read -r url; do wget -q -O - "${url}"; done < /tmp/chunks | tar -xf -
+%s
 set -x
-buildctl-daemonless.sh \
+%s \
  build \
+ --metadata-file /tmp/metadata.json \
  --frontend dockerfile.v0 \
  --local context=. \
  --local dockerfile=%s \
@@ -326,11 +408,13 @@ buildctl-daemonless.sh \
  %s \
  %s \
  %s \
- --export-cache=type=registry,ref=wedding-registry:5000/cache-repo,mode=max \
- --import-cache=type=registry,ref=wedding-registry:5000/cache-repo
-`, dockerfileDir, dockerfileName, buildargs, labels, target, destination)
+ %s \
+ --export-cache=type=registry,ref=%s/cache-repo,mode=max \
+ --import-cache=type=registry,ref=%s/cache-repo
+set +x
 
-	buildkitdMemory := 100 * 1024 * 1024
+echo "%s$(tr -d '\n' < /tmp/metadata.json)"
+`, scratchPath, scratchPath, waitForDaemon, buildctl, dockerfileDir, dockerfileName, buildargs, labels, target, platform, destination, config.Registry, config.Registry, metadataMarker)
 
 	pod := &corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
@@ -343,9 +427,9 @@ buildctl-daemonless.sh \
 		Spec: corev1.PodSpec{
 			Containers: []corev1.Container{
 				{
-					Image:   buildkitImage,
+					Image:   config.BuildkitImage,
 					Name:    "buildkit",
-					Command: []string{"timeout", strconv.Itoa(int(MaxExecutionTime / time.Second))},
+					Command: []string{"timeout", strconv.Itoa(int(timeout / time.Second))},
 					Args:    []string{"sh", "-c", buildScript},
 					VolumeMounts: []corev1.VolumeMount{
 						{
@@ -365,12 +449,12 @@ buildctl-daemonless.sh \
 					},
 					Resources: corev1.ResourceRequirements{
 						Limits: corev1.ResourceList{
-							corev1.ResourceCPU:    resource.MustParse(fmt.Sprintf("%dm", cfg.cpuMilliseconds)),
-							corev1.ResourceMemory: resource.MustParse(strconv.Itoa(cfg.memoryBytes + buildkitdMemory)),
+							corev1.ResourceCPU:    cpu,
+							corev1.ResourceMemory: memory,
 						},
 						Requests: corev1.ResourceList{
-							corev1.ResourceCPU:    resource.MustParse(fmt.Sprintf("%dm", cfg.cpuMilliseconds)),
-							corev1.ResourceMemory: resource.MustParse(strconv.Itoa(cfg.memoryBytes + buildkitdMemory)),
+							corev1.ResourceCPU:    cpu,
+							corev1.ResourceMemory: memory,
 						},
 					},
 				},
@@ -389,7 +473,7 @@ buildctl-daemonless.sh \
 					VolumeSource: corev1.VolumeSource{
 						ConfigMap: &corev1.ConfigMapVolumeSource{
 							LocalObjectReference: corev1.LocalObjectReference{
-								Name: "buildkitd-config",
+								Name: config.BuildkitdConfig,
 							},
 						},
 					},
@@ -399,50 +483,209 @@ buildctl-daemonless.sh \
 		},
 	}
 
-	o := &output{w: w}
-	d := &digestParser{w: o}
-	err = s.executePod(ctx, pod, d)
+	// only buildkit starting its own daemon needs to be unconfined
+	unconfined := "buildkit"
+	if pool.Replicas > 0 {
+		unconfined = ""
+	}
+	config.PodSecurity.secure(pod, unconfined)
+
+	addScratchVolume(pod, config, cfg.storage)
+	if pool.Replicas == 0 {
+		// keep the buildkit state on the scratch volume instead of the container layer
+		pod.Spec.Containers[0].Env = append(pod.Spec.Containers[0].Env, corev1.EnvVar{
+			Name:  "BUILDKITD_FLAGS",
+			Value: fmt.Sprintf("--root %s/buildkit", scratchPath),
+		})
+	}
+
+	m := &metadataParser{w: o}
+	err = s.executeJob(ctx, cfg.operation, pod, secret, m)
 	if err != nil {
+		m.Flush()
 		log.Printf("execute build: %v", err)
-		o.Errorf("execute build: %v", err)
+
+		code, message, ok := m.failure()
+		if !ok {
+			code, message = exitCode(err), fmt.Sprintf("execute build: %v", err)
+		}
+		if m.noSpace {
+			message += fmt.Sprintf(": build ran out of its %s disk space, request more with the header %s", cfg.storage.String(), buildStorageHeader)
+		}
+		o.ErrorCode(code, message)
+
+		return err
+	}
+
+	err = m.Flush()
+	if err != nil {
+		return err
+	}
+
+	if !m.found || m.metadata.ConfigDigest == "" {
+		o.Errorf(errNoImageID.Error())
+		return errNoImageID
+	}
+
+	repo := imageIDRepo
+	if len(cfg.tags) != 0 {
+		repo, _ = localImage(cfg.tags[0])
+	}
+
+	// docker refers to the image by the ID printed, after restarts as well
+	err = s.tagImageID(ctx, repo, m.metadata.ImageDigest, m.metadata.ConfigDigest)
+	if err != nil {
+		o.Errorf("tag image id: %v", err)
 		return err
 	}
 
-	err = d.publish(w)
+	err = m.publish(w)
 	if err != nil {
+		o.Errorf("publish image id: %v", err)
 		return err
 	}
 
 	return nil
 }
 
-type digestParser struct {
-	buf bytes.Buffer
-	w   io.Writer
+// buildMetadata is written by buildctl to the file passed as --metadata-file.
+type buildMetadata struct {
+	ImageDigest  string     `json:"containerimage.digest"`
+	ConfigDigest string     `json:"containerimage.config.digest"`
+	Descriptor   descriptor `json:"containerimage.descriptor"`
 }
 
-func (d *digestParser) publish(w io.Writer) error {
-	patterns := regexp.
-		MustCompile(`exporting manifest (sha256:[0-9a-f]+)`).
-		FindStringSubmatch(d.buf.String())
+// metadataParser forwards the build log and extracts the build metadata
+// the build script prints after buildctl finished.
+type metadataParser struct {
+	w        io.Writer
+	line     bytes.Buffer
+	metadata buildMetadata
+	found    bool
+
+	// steps are the names of the buildkit vertices by their number
+	steps      map[string]string
+	failedStep string
+	failedErr  string
+	noSpace    bool
+}
+
+func (m *metadataParser) Write(bb []byte) (int, error) {
+	n := len(bb)
+
+	for len(bb) > 0 {
+		idx := bytes.IndexByte(bb, '\n')
+		if idx == -1 {
+			m.line.Write(bb)
+			break
+		}
 
-	if len(patterns) != 2 || patterns[1] == "" {
-		return fmt.Errorf("digest not found")
+		m.line.Write(bb[:idx+1])
+		bb = bb[idx+1:]
+
+		err := m.handleLine()
+		if err != nil {
+			return 0, err
+		}
 	}
 
-	_, err := w.Write([]byte(fmt.Sprintf(`{"aux":{"ID":"%s"}}`, patterns[1])))
-	if err != nil {
+	return n, nil
+}
+
+// Flush handles a last line not terminated by a newline.
+func (m *metadataParser) Flush() error {
+	if m.line.Len() == 0 {
+		return nil
+	}
+
+	return m.handleLine()
+}
+
+func (m *metadataParser) handleLine() error {
+	defer m.line.Reset()
+
+	line := m.line.String()
+	if !strings.HasPrefix(line, metadataMarker) {
+		m.trackStep(strings.TrimRight(line, "\n"))
+
+		if strings.Contains(line, "no space left on device") {
+			m.noSpace = true
+		}
+
+		_, err := m.w.Write(m.line.Bytes())
 		return err
 	}
 
+	err := json.Unmarshal([]byte(strings.TrimPrefix(line, metadataMarker)), &m.metadata)
+	if err != nil {
+		return fmt.Errorf("decode build metadata: %v", err)
+	}
+
+	m.found = true
+
 	return nil
 }
 
-func (d *digestParser) Write(bb []byte) (int, error) {
-	_, err := d.buf.Write(bb)
+// trackStep remembers the names of buildkit steps from the plain progress output
+// and the step reported as failed, like
+//
+//	#8 [3/3] RUN make test
+//	#8 ERROR: executor failed running [/bin/sh -c make test]: exit code: 2
+func (m *metadataParser) trackStep(line string) {
+	match := vertexPattern.FindStringSubmatch(line)
+	if match == nil {
+		return
+	}
+
+	id, text := match[1], match[2]
+
+	if m.steps == nil {
+		m.steps = map[string]string{}
+	}
+
+	if strings.HasPrefix(text, "ERROR: ") {
+		if m.failedStep == "" {
+			m.failedStep = m.steps[id]
+			m.failedErr = strings.TrimPrefix(text, "ERROR: ")
+		}
+		return
+	}
+
+	// the first line of a vertex is its name, later lines are logs and status
+	if _, ok := m.steps[id]; !ok {
+		m.steps[id] = stagePattern.ReplaceAllString(text, "")
+	}
+}
+
+// failure describes the failed Dockerfile step with the exit code of its command.
+func (m *metadataParser) failure() (int, string, bool) {
+	if m.failedStep == "" {
+		return 0, "", false
+	}
+
+	match := exitCodePattern.FindStringSubmatch(m.failedErr)
+	if match == nil {
+		return 1, fmt.Sprintf("`%s` failed: %s", m.failedStep, m.failedErr), true
+	}
+
+	code, err := strconv.Atoi(match[1])
+	if err != nil {
+		code = 1
+	}
+
+	return code, fmt.Sprintf("`%s` exited with %d", m.failedStep, code), true
+}
+
+// publish reports the image config digest as image ID, matching docker and inspect.
+func (m *metadataParser) publish(w io.Writer) error {
+	if !m.found || m.metadata.ConfigDigest == "" {
+		return errNoImageID
+	}
+
+	_, err := w.Write([]byte(fmt.Sprintf(`{"aux":{"ID":"%s"}}`, m.metadata.ConfigDigest)))
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	return d.w.Write(bb)
+	return nil
 }
@@ -0,0 +1,408 @@
+package wedding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"path"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	cacheKeyHeader = "X-Wedding-Cache-Key"
+
+	buildkitdPort = 1234
+)
+
+// BuildkitdPool configures long-lived buildkitd daemons with persistent caches.
+// Builds connect to a daemon with buildctl instead of starting their own.
+// The pool is disabled with zero replicas.
+type BuildkitdPool struct {
+	Replicas     int    `json:"replicas" env:"WEDDING_BUILDKITD_POOL_REPLICAS"`
+	Name         string `json:"name" env:"WEDDING_BUILDKITD_POOL_NAME"`
+	CPU          string `json:"cpu" env:"WEDDING_BUILDKITD_POOL_CPU"`
+	Memory       string `json:"memory" env:"WEDDING_BUILDKITD_POOL_MEMORY"`
+	Storage      string `json:"storage" env:"WEDDING_BUILDKITD_POOL_STORAGE"`
+	StorageClass string `json:"storageClass" env:"WEDDING_BUILDKITD_POOL_STORAGE_CLASS"`
+	ClientCPU    string `json:"clientCPU" env:"WEDDING_BUILDKITD_POOL_CLIENT_CPU"`
+	ClientMemory string `json:"clientMemory" env:"WEDDING_BUILDKITD_POOL_CLIENT_MEMORY"`
+}
+
+func defaultBuildkitdPool() BuildkitdPool {
+	return BuildkitdPool{
+		Replicas:     0,
+		Name:         "wedding-buildkitd",
+		CPU:          "2",
+		Memory:       "4Gi",
+		Storage:      "20Gi",
+		ClientCPU:    "100m",
+		ClientMemory: "100Mi",
+	}
+}
+
+func (p BuildkitdPool) validate() error {
+	if p.Replicas < 0 {
+		return fmt.Errorf("buildkitdPool replicas %d is negative", p.Replicas)
+	}
+
+	if p.Replicas == 0 {
+		return nil
+	}
+
+	// pod names append the ordinal and the controller revision hash
+	errs := validation.IsDNS1035Label(p.Name)
+	if len(errs) != 0 || len(p.Name) > 52 {
+		return fmt.Errorf("buildkitdPool name %q is not a valid statefulset name: %s", p.Name, strings.Join(errs, ", "))
+	}
+
+	for name, value := range map[string]string{
+		"cpu":          p.CPU,
+		"memory":       p.Memory,
+		"storage":      p.Storage,
+		"clientCPU":    p.ClientCPU,
+		"clientMemory": p.ClientMemory,
+	} {
+		_, err := resource.ParseQuantity(value)
+		if err != nil {
+			return fmt.Errorf("buildkitdPool %s %q: %v", name, value, err)
+		}
+	}
+
+	return nil
+}
+
+// address selects the daemon for the cache key, the same key always reaches the same daemon.
+// The daemon is chosen by rendezvous hashing, resizing the pool only moves the keys
+// of added or removed daemons and keeps the caches of the others.
+// The address is resolved in the namespace of the build pod, every target runs its own pool.
+func (p BuildkitdPool) address(key string) string {
+	ordinal := 0
+	best := uint64(0)
+
+	for i := 0; i < p.Replicas; i++ {
+		h := fnv.New64a()
+		fmt.Fprintf(h, "%s/%d", key, i)
+
+		score := h.Sum64()
+		if i == 0 || score > best {
+			ordinal = i
+			best = score
+		}
+	}
+
+	return fmt.Sprintf("tcp://%s-%d.%s:%d", p.Name, ordinal, p.Name, buildkitdPort)
+}
+
+// buildCacheKey routes builds of the same image to the same daemon.
+// Clients can set the key explicitly, otherwise the repository of the first tag
+// or the Dockerfile path is used.
+func buildCacheKey(cacheKey string, cfg *buildConfig) string {
+	if cacheKey != "" {
+		return cacheKey
+	}
+
+	if len(cfg.tags) != 0 {
+		repo, _ := localImage(cfg.tags[0])
+		return repo
+	}
+
+	return path.Clean(cfg.dockerfile)
+}
+
+// EnsureBuildkitdPool creates or updates the statefulset and headless service of the buildkitd pool
+// on every target.
+// Targets failing are logged and skipped, it only fails if no target has a pool.
+// Without replicas an existing pool is left untouched, its volumes keep the caches.
+func (s Service) EnsureBuildkitdPool(ctx context.Context) error {
+	config := s.config()
+
+	if config.BuildkitdPool.Replicas == 0 {
+		return nil
+	}
+
+	failed := []string{}
+
+	for _, t := range s.targets {
+		err := ensureBuildkitdPool(ctx, t, config)
+		if err != nil {
+			log.Printf("buildkitd pool on target %s: %v", t.Name, err)
+			failed = append(failed, fmt.Sprintf("target %s: %v", t.Name, err))
+		}
+	}
+
+	if len(failed) == len(s.targets) && len(failed) != 0 {
+		return errors.New(strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+func ensureBuildkitdPool(ctx context.Context, t *target, config Config) error {
+	pool := config.BuildkitdPool
+
+	serviceClient := t.Client.CoreV1().Services(t.Namespace)
+
+	_, err := serviceClient.Create(ctx, buildkitdService(pool), metav1.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("create buildkitd service: %v", err)
+	}
+
+	err = ensureBuildkitdNetworkPolicy(ctx, t, pool)
+	if err != nil {
+		return err
+	}
+
+	statefulSetClient := t.Client.AppsV1().StatefulSets(t.Namespace)
+	desired := buildkitdStatefulSet(pool, config)
+
+	current, err := statefulSetClient.Get(ctx, pool.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = statefulSetClient.Create(ctx, desired, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("create buildkitd statefulset: %v", err)
+		}
+
+		log.Printf("created buildkitd pool %s with %d replicas on target %s", pool.Name, pool.Replicas, t.Name)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("get buildkitd statefulset: %v", err)
+	}
+
+	// volume claim templates can not be changed, only replicas and pods are updated
+	current.Spec.Replicas = desired.Spec.Replicas
+	current.Spec.Template = desired.Spec.Template
+
+	_, err = statefulSetClient.Update(ctx, current, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("update buildkitd statefulset: %v", err)
+	}
+
+	log.Printf("updated buildkitd pool %s to %d replicas on target %s", pool.Name, pool.Replicas, t.Name)
+
+	return nil
+}
+
+// ensureBuildkitdNetworkPolicy admits only build pods to the daemons.
+// buildkitd does not authenticate clients, any pod reaching it could run builds
+// and read the caches.
+func ensureBuildkitdNetworkPolicy(ctx context.Context, t *target, pool BuildkitdPool) error {
+	policyClient := t.Client.NetworkingV1().NetworkPolicies(t.Namespace)
+	desired := buildkitdNetworkPolicy(pool)
+
+	current, err := policyClient.Get(ctx, pool.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = policyClient.Create(ctx, desired, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("create buildkitd network policy: %v", err)
+		}
+
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("get buildkitd network policy: %v", err)
+	}
+
+	current.Spec = desired.Spec
+
+	_, err = policyClient.Update(ctx, current, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("update buildkitd network policy: %v", err)
+	}
+
+	return nil
+}
+
+func buildkitdNetworkPolicy(pool BuildkitdPool) *networkingv1.NetworkPolicy {
+	port := intstr.FromInt(buildkitdPort)
+	protocol := corev1.ProtocolTCP
+
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   pool.Name,
+			Labels: buildkitdLabels(pool),
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: buildkitdLabels(pool),
+			},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{
+				{
+					From: []networkingv1.NetworkPolicyPeer{
+						{
+							PodSelector: &metav1.LabelSelector{
+								MatchLabels: map[string]string{
+									"app": "wedding",
+									"job": "buildkit",
+								},
+							},
+						},
+					},
+					Ports: []networkingv1.NetworkPolicyPort{
+						{
+							Protocol: &protocol,
+							Port:     &port,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func buildkitdLabels(pool BuildkitdPool) map[string]string {
+	// pool pods are not labeled app=wedding, the garbage collection only removes job pods
+	return map[string]string{
+		"app":            "wedding-buildkitd",
+		"buildkitd-pool": pool.Name,
+	}
+}
+
+func buildkitdService(pool BuildkitdPool) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   pool.Name,
+			Labels: buildkitdLabels(pool),
+		},
+		Spec: corev1.ServiceSpec{
+			ClusterIP: corev1.ClusterIPNone,
+			Selector:  buildkitdLabels(pool),
+			Ports: []corev1.ServicePort{
+				{
+					Name:       "buildkitd",
+					Port:       buildkitdPort,
+					TargetPort: intstr.FromInt(buildkitdPort),
+				},
+			},
+		},
+	}
+}
+
+func buildkitdStatefulSet(pool BuildkitdPool, config Config) *appsv1.StatefulSet {
+	replicas := int32(pool.Replicas)
+	unconfined := corev1.SeccompProfile{Type: corev1.SeccompProfileTypeUnconfined}
+
+	var storageClass *string
+	if pool.StorageClass != "" {
+		storageClass = &pool.StorageClass
+	}
+
+	// freshly provisioned cache volumes belong to root, buildkitd runs as the pod user
+	securityContext := config.PodSecurity.podSecurityContext()
+	fsGroup := int64(config.PodSecurity.RunAsGroup)
+	securityContext.FSGroup = &fsGroup
+
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   pool.Name,
+			Labels: buildkitdLabels(pool),
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:            &replicas,
+			ServiceName:         pool.Name,
+			PodManagementPolicy: appsv1.ParallelPodManagement,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: buildkitdLabels(pool),
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: buildkitdLabels(pool),
+					Annotations: map[string]string{
+						apparmorAnnotationPrefix + "buildkitd": "unconfined",
+					},
+				},
+				Spec: corev1.PodSpec{
+					SecurityContext: securityContext,
+					Containers: []corev1.Container{
+						{
+							Name:  "buildkitd",
+							Image: config.BuildkitImage,
+							Args: []string{
+								"--addr", "unix:///run/user/1000/buildkit/buildkitd.sock",
+								"--addr", fmt.Sprintf("tcp://0.0.0.0:%d", buildkitdPort),
+								"--oci-worker-no-process-sandbox",
+							},
+							Ports: []corev1.ContainerPort{
+								{
+									Name:          "buildkitd",
+									ContainerPort: buildkitdPort,
+								},
+							},
+							ReadinessProbe: &corev1.Probe{
+								Handler: corev1.Handler{
+									Exec: &corev1.ExecAction{
+										Command: []string{"buildctl", "debug", "workers"},
+									},
+								},
+							},
+							SecurityContext: &corev1.SecurityContext{
+								SeccompProfile: &unconfined,
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{
+									MountPath: "/home/user/.local/share/buildkit",
+									Name:      "cache",
+								},
+								{
+									MountPath: "/home/user/.config/buildkit",
+									Name:      "buildkitd-config",
+								},
+							},
+							Resources: corev1.ResourceRequirements{
+								Limits: corev1.ResourceList{
+									corev1.ResourceCPU:    resource.MustParse(pool.CPU),
+									corev1.ResourceMemory: resource.MustParse(pool.Memory),
+								},
+								Requests: corev1.ResourceList{
+									corev1.ResourceCPU:    resource.MustParse(pool.CPU),
+									corev1.ResourceMemory: resource.MustParse(pool.Memory),
+								},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "buildkitd-config",
+							VolumeSource: corev1.VolumeSource{
+								ConfigMap: &corev1.ConfigMapVolumeSource{
+									LocalObjectReference: corev1.LocalObjectReference{
+										Name: config.BuildkitdConfig,
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:   "cache",
+						Labels: buildkitdLabels(pool),
+					},
+					Spec: corev1.PersistentVolumeClaimSpec{
+						AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+						StorageClassName: storageClass,
+						Resources: corev1.ResourceRequirements{
+							Requests: corev1.ResourceList{
+								corev1.ResourceStorage: resource.MustParse(pool.Storage),
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
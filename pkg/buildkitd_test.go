@@ -0,0 +1,155 @@
+package wedding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func Test_BuildkitdPool_address(t *testing.T) {
+	pool := defaultBuildkitdPool()
+	pool.Replicas = 3
+
+	first := pool.address("images/app")
+	if again := pool.address("images/app"); again != first {
+		t.Errorf("address() = %v, want the same daemon %v", again, first)
+	}
+
+	if !strings.HasPrefix(first, "tcp://wedding-buildkitd-") || !strings.HasSuffix(first, ".wedding-buildkitd:1234") {
+		t.Errorf("address() = %v, want a daemon of the pool", first)
+	}
+
+	daemons := map[string]bool{}
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		daemons[pool.address(key)] = true
+	}
+	if len(daemons) < 2 || len(daemons) > 3 {
+		t.Errorf("keys spread over %d daemons, want up to 3", len(daemons))
+	}
+
+	grown := pool
+	grown.Replicas = 4
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("images/app-%d", i)
+
+		address := grown.address(key)
+		if address != pool.address(key) && address != "tcp://wedding-buildkitd-3.wedding-buildkitd:1234" {
+			t.Errorf("address(%s) moved from %v to %v, want it to stay or move to the added daemon", key, pool.address(key), address)
+		}
+	}
+}
+
+func Test_buildCacheKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		cacheKey string
+		cfg      buildConfig
+		want     string
+	}{
+		{name: "header", cacheKey: "team-a", cfg: buildConfig{tags: []string{"app:dev"}}, want: "team-a"},
+		{name: "tag", cfg: buildConfig{tags: []string{"registry:5000/app:dev"}, dockerfile: "Dockerfile"}, want: "images/registry_5000/app"},
+		{name: "dockerfile", cfg: buildConfig{dockerfile: "./services/api/Dockerfile"}, want: "services/api/Dockerfile"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := buildCacheKey(tt.cacheKey, &tt.cfg); got != tt.want {
+				t.Errorf("buildCacheKey() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_EnsureBuildkitdPool(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+
+	cfg := DefaultConfig()
+	cfg.BuildkitdPool.Replicas = 2
+
+	s := Service{
+		targets:  []*target{{Target: Target{Name: "default", Namespace: "default", Client: client}}},
+		settings: newSettings(cfg),
+	}
+
+	err := s.EnsureBuildkitdPool(ctx)
+	if err != nil {
+		t.Fatalf("EnsureBuildkitdPool() error = %v", err)
+	}
+
+	cfg.BuildkitdPool.Replicas = 3
+	s.settings.config = cfg
+
+	err = s.EnsureBuildkitdPool(ctx)
+	if err != nil {
+		t.Fatalf("EnsureBuildkitdPool() update error = %v", err)
+	}
+
+	statefulSet, err := client.AppsV1().StatefulSets("default").Get(ctx, "wedding-buildkitd", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get statefulset: %v", err)
+	}
+	if *statefulSet.Spec.Replicas != 3 {
+		t.Errorf("replicas = %d, want 3", *statefulSet.Spec.Replicas)
+	}
+	if statefulSet.Spec.Template.Labels["app"] == "wedding" {
+		t.Errorf("pool pods are labeled app=wedding and would be garbage collected")
+	}
+	security := statefulSet.Spec.Template.Spec.SecurityContext
+	if security == nil || security.RunAsUser == nil || *security.RunAsUser != 1000 || security.FSGroup == nil || *security.FSGroup != 1000 {
+		t.Errorf("pool pod security context = %+v, want user 1000 owning the cache volume", security)
+	}
+
+	_, err = client.CoreV1().Services("default").Get(ctx, "wedding-buildkitd", metav1.GetOptions{})
+	if err != nil {
+		t.Errorf("get service: %v", err)
+	}
+
+	policy, err := client.NetworkingV1().NetworkPolicies("default").Get(ctx, "wedding-buildkitd", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get network policy: %v", err)
+	}
+	from := policy.Spec.Ingress[0].From[0].PodSelector.MatchLabels
+	if from["app"] != "wedding" || from["job"] != "buildkit" {
+		t.Errorf("network policy admits %v, want only build pods", from)
+	}
+}
+
+func Test_EnsureBuildkitdPool_unreachableTarget(t *testing.T) {
+	ctx := context.Background()
+
+	unreachable := fake.NewSimpleClientset()
+	unreachable.PrependReactor("*", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("connect: connection refused")
+	})
+
+	cfg := DefaultConfig()
+	cfg.BuildkitdPool.Replicas = 2
+
+	s := Service{
+		targets: []*target{
+			{Target: Target{Name: "unreachable", Namespace: "default", Client: unreachable}},
+			{Target: Target{Name: "default", Namespace: "default", Client: fake.NewSimpleClientset()}},
+		},
+		settings: newSettings(cfg),
+	}
+
+	err := s.EnsureBuildkitdPool(ctx)
+	if err != nil {
+		t.Fatalf("EnsureBuildkitdPool() error = %v, want the unreachable target skipped", err)
+	}
+
+	s.targets = s.targets[:1]
+
+	err = s.EnsureBuildkitdPool(ctx)
+	if err == nil {
+		t.Errorf("EnsureBuildkitdPool() succeeded without any reachable target")
+	}
+}
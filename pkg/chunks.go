@@ -0,0 +1,251 @@
+package wedding
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/restic/chunker"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+)
+
+const (
+	chunkPrefix    = "chunks/"
+	contextPrefix  = "contexts/"
+	manifestPrefix = "manifests/"
+
+	// contextPolynomial is fixed, the same content has to be cut into the same
+	// chunks for every upload to find the chunks stored before.
+	contextPolynomial = chunker.Pol(0x3DA3358B4DC173)
+)
+
+// chunkContext cuts the build context into content defined chunks named by their sha256 hash.
+// Changing a file only changes the chunks around it.
+func chunkContext(r io.Reader, chunk func(key string, data []byte) error) error {
+	chunks := chunker.New(r, contextPolynomial)
+
+	for {
+		c, err := chunks.Next(nil)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read build context: %v", err)
+		}
+
+		sum := sha256.Sum256(c.Data)
+
+		err = chunk(chunkPrefix+hex.EncodeToString(sum[:]), c.Data)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// storeChunks uploads the chunks of the build context missing in the bucket
+// and the manifest of the chunks the context uses.
+// The chunks are tracked as inflight, the caller releases them after the build.
+func (o ObjectStore) storeChunks(ctx context.Context, r io.Reader, cfg *buildConfig, inflight *inflight, chunkTTL time.Duration) error {
+	// chunks are referenced by the manifest only once all chunks are stored,
+	// until then chunks must not come close to the ttl
+	renewBefore := time.Now().Add(-chunkTTL / 2)
+
+	sem := semaphore.NewWeighted(parallelTransfers)
+	g, gctx := errgroup.WithContext(ctx)
+
+	err := chunkContext(r, func(key string, data []byte) error {
+		// chunks in use are not garbage collected between checking and using them
+		inflight.add(key)
+		cfg.contextChunks = append(cfg.contextChunks, key)
+
+		// limits the chunks held in memory as well
+		err := sem.Acquire(gctx, 1)
+		if err != nil {
+			return err
+		}
+
+		g.Go(func() error {
+			defer sem.Release(1)
+
+			return o.storeChunk(gctx, key, data, renewBefore)
+		})
+
+		return nil
+	})
+
+	uploadErr := g.Wait()
+	if err == nil {
+		err = uploadErr
+	}
+	if err == nil {
+		err = o.storeManifest(ctx, cfg)
+	}
+	if err != nil {
+		for _, key := range cfg.contextChunks {
+			inflight.remove(key)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// storeChunk uploads the chunk unless the bucket has it already.
+// Chunks last modified before renewBefore are uploaded again, they might
+// be garbage collected before the manifest referencing them is written.
+func (o ObjectStore) storeChunk(ctx context.Context, key string, data []byte, renewBefore time.Time) error {
+	head, err := o.Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(o.Bucket),
+		Key:    aws.String(key),
+	})
+	if err == nil && aws.TimeValue(head.LastModified).After(renewBefore) {
+		return nil
+	}
+
+	failure, ok := err.(awserr.RequestFailure)
+	if err != nil && (!ok || failure.StatusCode() != http.StatusNotFound) {
+		return fmt.Errorf("check chunk %s: %v", key, err)
+	}
+
+	_, err = o.Uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:      aws.String(o.Bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String("application/octet-stream"),
+		Body:        bytes.NewReader(data),
+	})
+	if err != nil {
+		return fmt.Errorf("upload chunk %s: %v", key, err)
+	}
+
+	return nil
+}
+
+// storeManifest uploads the keys of the chunks the context uses, one per line.
+// The garbage collection keeps chunks referenced by manifests.
+func (o ObjectStore) storeManifest(ctx context.Context, cfg *buildConfig) error {
+	key := manifestKey(cfg.contextFilePath)
+
+	_, err := o.Uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:      aws.String(o.Bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String("text/plain"),
+		Metadata: aws.StringMap(map[string]string{
+			operationIDLabel:   cfg.operation.id,
+			operationTypeLabel: cfg.operation.kind,
+		}),
+		Body: strings.NewReader(strings.Join(cfg.contextChunks, "\n")),
+	})
+	if err != nil {
+		return fmt.Errorf("upload chunk manifest: %v", err)
+	}
+
+	return nil
+}
+
+// referencedChunks reads the manifests of all contexts and returns the chunks they use.
+func (o ObjectStore) referencedChunks(ctx context.Context) (map[string]bool, error) {
+	keys := []string{}
+
+	err := o.Client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(o.Bucket),
+		Prefix: aws.String(manifestPrefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			keys = append(keys, aws.StringValue(object.Key))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list %s: %v", manifestPrefix, err)
+	}
+
+	referenced := map[string]bool{}
+
+	for _, key := range keys {
+		object, err := o.Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(o.Bucket),
+			Key:    aws.String(key),
+		})
+		if failure, ok := err.(awserr.RequestFailure); ok && failure.StatusCode() == http.StatusNotFound {
+			// the build finished since listing the manifests
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("get chunk manifest %s: %v", key, err)
+		}
+
+		err = readManifest(object.Body, referenced)
+		object.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read chunk manifest %s: %v", key, err)
+		}
+	}
+
+	return referenced, nil
+}
+
+// readManifest adds the chunk keys of a manifest to chunks.
+func readManifest(r io.Reader, chunks map[string]bool) error {
+	lines := bufio.NewScanner(r)
+	for lines.Scan() {
+		key := strings.TrimSpace(lines.Text())
+		if key != "" {
+			chunks[key] = true
+		}
+	}
+
+	return lines.Err()
+}
+
+// manifestKey returns the key of the chunk manifest of a context.
+func manifestKey(contextFilePath string) string {
+	return manifestPrefix + strings.TrimPrefix(contextFilePath, contextPrefix)
+}
+
+// storeChunkList uploads the list of presigned chunk urls the build pod downloads
+// the context from, one url per line in the order of the context.
+func (o ObjectStore) storeChunkList(ctx context.Context, cfg *buildConfig, expiry time.Duration) error {
+	urls := &strings.Builder{}
+
+	for _, key := range cfg.contextChunks {
+		request, _ := o.Client.GetObjectRequest(&s3.GetObjectInput{
+			Bucket: aws.String(o.Bucket),
+			Key:    aws.String(key),
+		})
+
+		url, err := request.Presign(expiry)
+		if err != nil {
+			return fmt.Errorf("presign GET %s: %v", key, err)
+		}
+
+		fmt.Fprintln(urls, url)
+	}
+
+	_, err := o.Uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:      aws.String(o.Bucket),
+		Key:         aws.String(cfg.contextFilePath),
+		ContentType: aws.String("text/plain"),
+		Metadata: aws.StringMap(map[string]string{
+			operationIDLabel:   cfg.operation.id,
+			operationTypeLabel: cfg.operation.kind,
+		}),
+		Body: strings.NewReader(urls.String()),
+	})
+	if err != nil {
+		return fmt.Errorf("upload chunk list: %v", err)
+	}
+
+	return nil
+}
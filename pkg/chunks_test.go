@@ -0,0 +1,78 @@
+package wedding
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_chunkContext(t *testing.T) {
+	context := make([]byte, 16<<20)
+	rand.New(rand.NewSource(1)).Read(context)
+
+	// a file changed at the start of the context
+	changed := append([]byte("FROM alpine\n"), context...)
+
+	chunk := func(data []byte) ([]string, []byte) {
+		keys := []string{}
+		joined := &bytes.Buffer{}
+
+		err := chunkContext(bytes.NewReader(data), func(key string, data []byte) error {
+			keys = append(keys, key)
+			joined.Write(data)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("chunkContext() error = %v", err)
+		}
+
+		return keys, joined.Bytes()
+	}
+
+	keys, joined := chunk(context)
+	if !bytes.Equal(joined, context) {
+		t.Errorf("chunks do not reassemble the context")
+	}
+	if len(keys) < 2 {
+		t.Fatalf("chunkContext() cut %d chunks, want several", len(keys))
+	}
+
+	stored := map[string]bool{}
+	for _, key := range keys {
+		stored[key] = true
+	}
+
+	changedKeys, _ := chunk(changed)
+
+	uploads := 0
+	for _, key := range changedKeys {
+		if !stored[key] {
+			uploads++
+		}
+	}
+	if uploads != 1 {
+		t.Errorf("changed context needs %d new chunks of %d, want 1", uploads, len(changedKeys))
+	}
+}
+
+func Test_readManifest(t *testing.T) {
+	cfg := &buildConfig{contextChunks: []string{"chunks/aa", "chunks/bb", "chunks/aa"}}
+
+	chunks := map[string]bool{"chunks/cc": true}
+
+	err := readManifest(strings.NewReader(strings.Join(cfg.contextChunks, "\n")), chunks)
+	if err != nil {
+		t.Fatalf("readManifest() error = %v", err)
+	}
+
+	want := map[string]bool{"chunks/aa": true, "chunks/bb": true, "chunks/cc": true}
+	if !reflect.DeepEqual(chunks, want) {
+		t.Errorf("readManifest() = %v, want %v", chunks, want)
+	}
+
+	if got := manifestKey("contexts/1234"); got != "manifests/1234" {
+		t.Errorf("manifestKey() = %v, want manifests/1234", got)
+	}
+}
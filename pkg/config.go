@@ -0,0 +1,339 @@
+package wedding
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+// Config contains the server settings read from a YAML or JSON file.
+// Every field can be overridden by the environment variable named in its env tag.
+type Config struct {
+	BuildkitImage      string          `json:"buildkitImage" env:"WEDDING_BUILDKIT_IMAGE"`
+	SkopeoImage        string          `json:"skopeoImage" env:"WEDDING_SKOPEO_IMAGE"`
+	BuildCPU           string          `json:"buildCPU" env:"WEDDING_BUILD_CPU"`
+	BuildMemory        string          `json:"buildMemory" env:"WEDDING_BUILD_MEMORY"`
+	BuildkitdMemory    string          `json:"buildkitdMemory" env:"WEDDING_BUILDKITD_MEMORY"`
+	BuildStorage       string          `json:"buildStorage" env:"WEDDING_BUILD_STORAGE"`
+	MaxBuildStorage    string          `json:"maxBuildStorage" env:"WEDDING_MAX_BUILD_STORAGE"`
+	BuildScratchVolume string          `json:"buildScratchVolume" env:"WEDDING_BUILD_SCRATCH_VOLUME"`
+	BuildStorageClass  string          `json:"buildStorageClass" env:"WEDDING_BUILD_STORAGE_CLASS"`
+	SkopeoCPU          string          `json:"skopeoCPU" env:"WEDDING_SKOPEO_CPU"`
+	SkopeoMemory       string          `json:"skopeoMemory" env:"WEDDING_SKOPEO_MEMORY"`
+	Registry           string          `json:"registry" env:"WEDDING_REGISTRY"`
+	BuildkitdConfig    string          `json:"buildkitdConfig" env:"WEDDING_BUILDKITD_CONFIG"`
+	DefaultPlatform    string          `json:"defaultPlatform" env:"WEDDING_DEFAULT_PLATFORM"`
+	MaxExecutionTime   metav1.Duration `json:"maxExecutionTime" env:"WEDDING_MAX_EXECUTION_TIME"`
+	MaxBuildTimeout    metav1.Duration `json:"maxBuildTimeout" env:"WEDDING_MAX_BUILD_TIMEOUT"`
+	MaxSkopeoTimeout   metav1.Duration `json:"maxSkopeoTimeout" env:"WEDDING_MAX_SKOPEO_TIMEOUT"`
+	MaxPendingTime     metav1.Duration `json:"maxPendingTime" env:"WEDDING_MAX_PENDING_TIME"`
+	ContextChunkTTL    metav1.Duration `json:"contextChunkTTL" env:"WEDDING_CONTEXT_CHUNK_TTL"`
+	MaxBuilds          int             `json:"maxBuilds" env:"WEDDING_MAX_BUILDS"`
+	MaxSkopeoJobs      int             `json:"maxSkopeoJobs" env:"WEDDING_MAX_SKOPEO_JOBS"`
+	BuildkitdPool      BuildkitdPool   `json:"buildkitdPool"`
+	PodSecurity        PodSecurity     `json:"podSecurity"`
+}
+
+// DefaultConfig returns the settings used for fields missing in the config file.
+func DefaultConfig() Config {
+	return Config{
+		BuildkitImage:      "moby/buildkit:v0.9.3-rootless",
+		SkopeoImage:        "ghcr.io/utopia-planitia/skopeo-image@sha256:130836bd82e5f3a856f659e22f0e9d97c545ff0d955807b806595ec4874d5f37",
+		BuildCPU:           "1",
+		BuildMemory:        "2Gi",
+		BuildkitdMemory:    "100Mi",
+		BuildStorage:       "10Gi",
+		MaxBuildStorage:    "50Gi",
+		BuildScratchVolume: scratchEmptyDir,
+		SkopeoCPU:          "200m",
+		SkopeoMemory:       "100Mi",
+		Registry:           "wedding-registry:5000",
+		BuildkitdConfig:    "buildkitd-config",
+		MaxExecutionTime:   metav1.Duration{Duration: 30 * time.Minute},
+		MaxBuildTimeout:    metav1.Duration{Duration: time.Hour},
+		MaxSkopeoTimeout:   metav1.Duration{Duration: 30 * time.Minute},
+		MaxPendingTime:     metav1.Duration{Duration: 5 * time.Minute},
+		ContextChunkTTL:    metav1.Duration{Duration: 24 * time.Hour},
+		MaxBuilds:          10,
+		MaxSkopeoJobs:      5,
+		BuildkitdPool:      defaultBuildkitdPool(),
+		PodSecurity:        defaultPodSecurity(),
+	}
+}
+
+// LoadConfig reads the config file, applies environment overrides and validates the result.
+// Without a path the defaults and environment overrides are used.
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("read config: %v", err)
+		}
+
+		err = yaml.UnmarshalStrict(b, &cfg)
+		if err != nil {
+			return cfg, fmt.Errorf("decode config %s: %v", path, err)
+		}
+	}
+
+	err := cfg.applyEnv(os.LookupEnv)
+	if err != nil {
+		return cfg, err
+	}
+
+	err = cfg.validate()
+	if err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	return applyEnv(reflect.ValueOf(c).Elem(), lookup)
+}
+
+func applyEnv(v reflect.Value, lookup func(string) (string, bool)) error {
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Tag.Get("env")
+
+		// sections like the buildkitd pool have no env tag, their fields do
+		if name == "" && v.Field(i).Kind() == reflect.Struct {
+			err := applyEnv(v.Field(i), lookup)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+
+		switch field := v.Field(i).Addr().Interface().(type) {
+		case *string:
+			*field = value
+		case *int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("parse %s: %v", name, err)
+			}
+			*field = n
+		case *bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("parse %s: %v", name, err)
+			}
+			*field = b
+		case *metav1.Duration:
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("parse %s: %v", name, err)
+			}
+			field.Duration = d
+		default:
+			return fmt.Errorf("unsupported type of %s", name)
+		}
+	}
+
+	return nil
+}
+
+func (c Config) validate() error {
+	if c.BuildkitImage == "" {
+		return fmt.Errorf("buildkitImage is empty")
+	}
+
+	if c.SkopeoImage == "" {
+		return fmt.Errorf("skopeoImage is empty")
+	}
+
+	quantities := []struct {
+		name  string
+		value string
+	}{
+		{"buildCPU", c.BuildCPU},
+		{"buildMemory", c.BuildMemory},
+		{"buildkitdMemory", c.BuildkitdMemory},
+		{"buildStorage", c.BuildStorage},
+		{"maxBuildStorage", c.MaxBuildStorage},
+		{"skopeoCPU", c.SkopeoCPU},
+		{"skopeoMemory", c.SkopeoMemory},
+	}
+	for _, q := range quantities {
+		quantity, err := resource.ParseQuantity(q.value)
+		if err != nil {
+			return fmt.Errorf("%s %q: %v", q.name, q.value, err)
+		}
+		if quantity.Sign() <= 0 {
+			return fmt.Errorf("%s %q is not positive", q.name, q.value)
+		}
+	}
+
+	storage := resource.MustParse(c.BuildStorage)
+	if storage.Cmp(resource.MustParse(c.MaxBuildStorage)) > 0 {
+		return fmt.Errorf("buildStorage %s exceeds maxBuildStorage %s", c.BuildStorage, c.MaxBuildStorage)
+	}
+
+	if !scratchVolumes[c.BuildScratchVolume] {
+		return fmt.Errorf("buildScratchVolume %q is not one of emptyDir, memory or ephemeral", c.BuildScratchVolume)
+	}
+
+	if c.Registry == "" || strings.Contains(c.Registry, "/") {
+		return fmt.Errorf("registry %q is not a host", c.Registry)
+	}
+
+	errs := validation.IsDNS1123Subdomain(c.BuildkitdConfig)
+	if len(errs) != 0 {
+		return fmt.Errorf("buildkitdConfig %q: %s", c.BuildkitdConfig, strings.Join(errs, ", "))
+	}
+
+	if c.DefaultPlatform != "" && !platformPattern.MatchString(c.DefaultPlatform) {
+		return fmt.Errorf("defaultPlatform %q is not a platform", c.DefaultPlatform)
+	}
+
+	// jobs are limited in seconds
+	if c.MaxExecutionTime.Duration < time.Second {
+		return fmt.Errorf("maxExecutionTime %v is shorter than 1s", c.MaxExecutionTime.Duration)
+	}
+
+	if c.MaxBuildTimeout.Duration < time.Second {
+		return fmt.Errorf("maxBuildTimeout %v is shorter than 1s", c.MaxBuildTimeout.Duration)
+	}
+
+	if c.MaxSkopeoTimeout.Duration < time.Second {
+		return fmt.Errorf("maxSkopeoTimeout %v is shorter than 1s", c.MaxSkopeoTimeout.Duration)
+	}
+
+	if c.MaxExecutionTime.Duration > c.MaxBuildTimeout.Duration || c.MaxExecutionTime.Duration > c.MaxSkopeoTimeout.Duration {
+		return fmt.Errorf("maxExecutionTime %v exceeds maxBuildTimeout %v or maxSkopeoTimeout %v", c.MaxExecutionTime.Duration, c.MaxBuildTimeout.Duration, c.MaxSkopeoTimeout.Duration)
+	}
+
+	if c.MaxPendingTime.Duration <= 0 {
+		return fmt.Errorf("maxPendingTime %v is not positive", c.MaxPendingTime.Duration)
+	}
+
+	if c.ContextChunkTTL.Duration < c.LongestTimeout() {
+		return fmt.Errorf("contextChunkTTL %v is shorter than the longest timeout %v", c.ContextChunkTTL.Duration, c.LongestTimeout())
+	}
+
+	if c.MaxBuilds <= 0 {
+		return fmt.Errorf("maxBuilds %d is not positive", c.MaxBuilds)
+	}
+
+	if c.MaxSkopeoJobs <= 0 {
+		return fmt.Errorf("maxSkopeoJobs %d is not positive", c.MaxSkopeoJobs)
+	}
+
+	err := c.BuildkitdPool.validate()
+	if err != nil {
+		return err
+	}
+
+	return c.PodSecurity.validate()
+}
+
+// timeout is the execution time of the operation. Clients can request a timeout
+// up to the maximum of the job type, otherwise the maximum execution time applies.
+func (c Config) timeout(op operation) time.Duration {
+	if op.timeout == 0 {
+		return c.MaxExecutionTime.Duration
+	}
+
+	max := c.MaxSkopeoTimeout.Duration
+	if op.kind == buildOperation {
+		max = c.MaxBuildTimeout.Duration
+	}
+
+	if op.timeout > max {
+		return max
+	}
+
+	return op.timeout
+}
+
+// LongestTimeout is the longest time any job can run.
+func (c Config) LongestTimeout() time.Duration {
+	longest := c.MaxExecutionTime.Duration
+
+	for _, timeout := range []time.Duration{c.MaxBuildTimeout.Duration, c.MaxSkopeoTimeout.Duration} {
+		if timeout > longest {
+			longest = timeout
+		}
+	}
+
+	return longest
+}
+
+func (c Config) buildCPUMilliseconds() int {
+	quantity := resource.MustParse(c.BuildCPU)
+	return int(quantity.MilliValue())
+}
+
+func (c Config) buildMemoryBytes() int {
+	quantity := resource.MustParse(c.BuildMemory)
+	return int(quantity.Value())
+}
+
+// settings holds the current config and the state derived from it.
+// They are replaced as a whole when the config is reloaded.
+type settings struct {
+	mu       sync.RWMutex
+	config   Config
+	registry *registry
+}
+
+func newSettings(cfg Config) *settings {
+	return &settings{
+		config:   cfg,
+		registry: newLocalRegistry(cfg.Registry),
+	}
+}
+
+// Reload applies a new config to requests started from now on.
+// Running requests finish with the config they started with.
+func (s Service) Reload(cfg Config) {
+	s.settings.mu.Lock()
+	defer s.settings.mu.Unlock()
+
+	old := s.settings.config
+
+	if cfg.Registry != old.Registry {
+		s.settings.registry = newLocalRegistry(cfg.Registry)
+	}
+
+	s.builds.setLimit(cfg.MaxBuilds)
+	s.skopeoJobs.setLimit(cfg.MaxSkopeoJobs)
+
+	s.settings.config = cfg
+
+	log.Printf("config reloaded: %+v", cfg)
+}
+
+func (s Service) config() Config {
+	s.settings.mu.RLock()
+	defer s.settings.mu.RUnlock()
+
+	return s.settings.config
+}
+
+func (s Service) localRegistry() *registry {
+	s.settings.mu.RLock()
+	defer s.settings.mu.RUnlock()
+
+	return s.settings.registry
+}
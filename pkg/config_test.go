@@ -0,0 +1,131 @@
+package wedding
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_LoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := ioutil.WriteFile(path, []byte(`
+buildkitImage: moby/buildkit:v0.10.0-rootless
+registry: registry.example.com:5000
+maxExecutionTime: 20m
+`), 0600)
+	if err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	got, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+
+	want := DefaultConfig()
+	want.BuildkitImage = "moby/buildkit:v0.10.0-rootless"
+	want.Registry = "registry.example.com:5000"
+	want.MaxExecutionTime.Duration = 20 * time.Minute
+
+	if got != want {
+		t.Errorf("LoadConfig() = %+v, want %+v", got, want)
+	}
+
+	err = ioutil.WriteFile(path, []byte("buildkitImgae: typo\n"), 0600)
+	if err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	_, err = LoadConfig(path)
+	if err == nil {
+		t.Errorf("LoadConfig() accepted unknown field")
+	}
+}
+
+func Test_Config_applyEnv(t *testing.T) {
+	env := map[string]string{
+		"WEDDING_SKOPEO_IMAGE":            "quay.io/skopeo/stable",
+		"WEDDING_MAX_SKOPEO_JOBS":         "2",
+		"WEDDING_MAX_EXECUTION_TIME":      "45m",
+		"WEDDING_POD_SECURITY_HOST_USERS": "false",
+	}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	got := DefaultConfig()
+
+	err := got.applyEnv(lookup)
+	if err != nil {
+		t.Fatalf("applyEnv() error = %v", err)
+	}
+
+	want := DefaultConfig()
+	want.SkopeoImage = "quay.io/skopeo/stable"
+	want.MaxSkopeoJobs = 2
+	want.MaxExecutionTime.Duration = 45 * time.Minute
+	want.PodSecurity.HostUsers = false
+
+	if got != want {
+		t.Errorf("applyEnv() = %+v, want %+v", got, want)
+	}
+
+	env["WEDDING_MAX_SKOPEO_JOBS"] = "many"
+
+	err = got.applyEnv(lookup)
+	if err == nil {
+		t.Errorf("applyEnv() accepted invalid number")
+	}
+}
+
+func Test_Config_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		wantErr bool
+	}{
+		{name: "defaults", modify: func(c *Config) {}},
+		{name: "empty image", modify: func(c *Config) { c.BuildkitImage = "" }, wantErr: true},
+		{name: "invalid memory", modify: func(c *Config) { c.BuildMemory = "2 gigabyte" }, wantErr: true},
+		{name: "zero cpu", modify: func(c *Config) { c.SkopeoCPU = "0" }, wantErr: true},
+		{name: "registry with path", modify: func(c *Config) { c.Registry = "registry:5000/images" }, wantErr: true},
+		{name: "invalid configmap name", modify: func(c *Config) { c.BuildkitdConfig = "Buildkitd_Config" }, wantErr: true},
+		{name: "no execution time", modify: func(c *Config) { c.MaxExecutionTime.Duration = 0 }, wantErr: true},
+		{name: "sub-second build timeout", modify: func(c *Config) { c.MaxBuildTimeout.Duration = 500 * time.Millisecond }, wantErr: true},
+		{name: "execution time above skopeo timeout", modify: func(c *Config) { c.MaxExecutionTime.Duration = time.Hour }, wantErr: true},
+		{name: "no skopeo jobs", modify: func(c *Config) { c.MaxSkopeoJobs = 0 }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			tt.modify(&c)
+
+			if err := c.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Config.validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_Config_timeout(t *testing.T) {
+	tests := []struct {
+		name string
+		op   operation
+		want time.Duration
+	}{
+		{name: "default", op: operation{kind: buildOperation}, want: 30 * time.Minute},
+		{name: "shorter", op: operation{kind: buildOperation, timeout: 10 * time.Minute}, want: 10 * time.Minute},
+		{name: "longer build", op: operation{kind: buildOperation, timeout: 50 * time.Minute}, want: 50 * time.Minute},
+		{name: "build capped", op: operation{kind: buildOperation, timeout: 3 * time.Hour}, want: time.Hour},
+		{name: "pull capped", op: operation{kind: pullAction, timeout: time.Hour}, want: 30 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DefaultConfig().timeout(tt.op); got != tt.want {
+				t.Errorf("Config.timeout() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package wedding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+)
+
+const (
+	// CopyEngineInProcess copies images by talking to the registries directly.
+	CopyEngineInProcess = "in-process"
+	// CopyEngineSkopeo copies images by running skopeo pods.
+	CopyEngineSkopeo = "skopeo"
+
+	parallelTransfers = 3
+	progressInterval  = 100 * time.Millisecond
+)
+
+// imageCopy transfers an image between two registries and reports
+// the progress of every layer as docker jsonmessages.
+type imageCopy struct {
+	src     *registry
+	srcRepo string
+	dst     *registry
+	dstRepo string
+	action  string
+
+	mu          sync.Mutex
+	o           *output
+	transferred bool
+}
+
+func newImageCopy(o *output, action string, src *registry, srcRepo string, dst *registry, dstRepo string) *imageCopy {
+	return &imageCopy{
+		src:     src,
+		srcRepo: srcRepo,
+		dst:     dst,
+		dstRepo: dstRepo,
+		action:  action,
+		o:       o,
+	}
+}
+
+// copy transfers all blobs of the manifest and stores the manifest as reference.
+// Manifest lists are copied including all referenced manifests.
+func (c *imageCopy) copy(ctx context.Context, m *manifest, reference string) error {
+	content, err := m.content()
+	if err != nil {
+		return err
+	}
+
+	for _, child := range content.Manifests {
+		childManifest, err := c.src.getManifest(ctx, c.srcRepo, child.Digest)
+		if err != nil {
+			return err
+		}
+
+		err = c.copy(ctx, childManifest, child.Digest)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.copyBlobs(ctx, content)
+	if err != nil {
+		return err
+	}
+
+	return c.dst.putManifest(ctx, c.dstRepo, reference, m)
+}
+
+func (c *imageCopy) copyBlobs(ctx context.Context, content *manifestContent) error {
+	sem := semaphore.NewWeighted(parallelTransfers)
+	g, ctx := errgroup.WithContext(ctx)
+
+	for _, layer := range content.Layers {
+		c.status(layer, c.words().prepare)
+	}
+
+	for _, blob := range content.blobs() {
+		blob := blob
+		isLayer := blob.Digest != content.Config.Digest
+
+		g.Go(func() error {
+			err := sem.Acquire(ctx, 1)
+			if err != nil {
+				return err
+			}
+			defer sem.Release(1)
+
+			return c.copyBlob(ctx, blob, isLayer)
+		})
+	}
+
+	return g.Wait()
+}
+
+func (c *imageCopy) copyBlob(ctx context.Context, blob descriptor, isLayer bool) error {
+	exists, err := c.dst.blobExists(ctx, c.dstRepo, blob.Digest)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		if isLayer {
+			c.status(blob, c.words().exists)
+		}
+		return nil
+	}
+
+	mountFrom := ""
+	if c.src.host == c.dst.host {
+		mountFrom = c.srcRepo
+	}
+
+	mounted, location, err := c.dst.startUpload(ctx, c.dstRepo, mountFrom, blob.Digest)
+	if err != nil {
+		return err
+	}
+
+	if mounted {
+		if isLayer {
+			c.status(blob, fmt.Sprintf("Mounted from %s", c.srcRepo))
+		}
+		return nil
+	}
+
+	err = c.uploadBlob(ctx, blob, isLayer, location)
+	if errors.Is(err, errNotReplayable) {
+		// the token expired or did not cover the upload, the registry is authenticated now
+		_, location, err = c.dst.startUpload(ctx, c.dstRepo, "", blob.Digest)
+		if err != nil {
+			return err
+		}
+
+		err = c.uploadBlob(ctx, blob, isLayer, location)
+	}
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.transferred = true
+	c.mu.Unlock()
+
+	if isLayer {
+		c.progress(blob, blob.Size)
+		for _, status := range c.words().complete {
+			c.status(blob, status)
+		}
+	}
+
+	return nil
+}
+
+// uploadBlob streams the blob from the source to the upload location.
+func (c *imageCopy) uploadBlob(ctx context.Context, blob descriptor, isLayer bool, location string) error {
+	body, err := c.src.openBlob(ctx, c.srcRepo, blob.Digest)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	var r io.Reader = body
+	if isLayer {
+		r = &progressReader{
+			r: body,
+			report: func(current int64) {
+				c.progress(blob, current)
+			},
+		}
+	}
+
+	return c.dst.uploadBlob(ctx, location, blob.Digest, blob.Size, r)
+}
+
+type progressWords struct {
+	prepare  string
+	transfer string
+	exists   string
+	complete []string
+}
+
+func (c *imageCopy) words() progressWords {
+	if c.action == pushAction {
+		return progressWords{
+			prepare:  "Preparing",
+			transfer: "Pushing",
+			exists:   "Layer already exists",
+			complete: []string{"Pushed"},
+		}
+	}
+
+	return progressWords{
+		prepare:  "Pulling fs layer",
+		transfer: "Downloading",
+		exists:   "Already exists",
+		complete: []string{"Download complete", "Pull complete"},
+	}
+}
+
+func (c *imageCopy) status(blob descriptor, status string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.o.Status(shortID(blob.Digest), status)
+}
+
+func (c *imageCopy) progress(blob descriptor, current int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.o.Progress(shortID(blob.Digest), c.words().transfer, current, blob.Size)
+}
+
+// progressReader reports the number of bytes read, at most once per progressInterval.
+type progressReader struct {
+	r        io.Reader
+	current  int64
+	reported time.Time
+	report   func(current int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.current += int64(n)
+
+	if time.Since(p.reported) > progressInterval {
+		p.reported = time.Now()
+		p.report(p.current)
+	}
+
+	return n, err
+}
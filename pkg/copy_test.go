@@ -0,0 +1,61 @@
+package wedding
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_imageCopy_copyBlob_authenticateUpload(t *testing.T) {
+	layer := []byte("layer")
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(layer))
+
+	uploads := 0
+	var uploaded []byte
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			w.Write([]byte(`{"token": "push"}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/v2/src/blobs/"+digest:
+			w.Write(layer)
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodPost:
+			uploads++
+			w.Header().Set("Location", fmt.Sprintf("/v2/dst/blobs/uploads/%d", uploads))
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodPut && r.Header.Get("Authorization") != "Bearer push":
+			// the upload needs a token, starting it did not
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry",scope="repository:dst:push"`, srv.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.Method == http.MethodPut:
+			uploaded, _ = ioutil.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	c := newImageCopy(&output{w: httptest.NewRecorder()}, pushAction, newLocalRegistry(host), "src", newLocalRegistry(host), "dst")
+
+	err := c.copyBlob(context.Background(), descriptor{Digest: digest, Size: int64(len(layer))}, true)
+	if err != nil {
+		t.Fatalf("copyBlob() error = %v", err)
+	}
+
+	if string(uploaded) != string(layer) {
+		t.Errorf("uploaded %q, want %q", uploaded, layer)
+	}
+	if uploads != 2 {
+		t.Errorf("started %d uploads, want the upload started again after authenticating", uploads)
+	}
+}
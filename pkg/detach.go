@@ -0,0 +1,239 @@
+package wedding
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// buildKeyHeader opts into detached builds. Builds with the same key, arguments
+	// and context are the same build and can be reattached to.
+	buildKeyHeader = "X-Wedding-Build-Key"
+	buildIDHeader  = "X-Wedding-Build-Id"
+
+	detachedBuildRetention = 10 * time.Minute
+
+	// detachedLogLimit is the size of the build output kept for clients attaching later,
+	// older messages are dropped.
+	detachedLogLimit = 4 << 20
+)
+
+// detachedBuilds keeps builds running independent of the requests started them.
+type detachedBuilds struct {
+	mu     sync.Mutex
+	builds map[string]*detachedBuild
+}
+
+// detachedBuild records the output of a build for all clients attached to it.
+// The log keeps the messages written, dropped counts the messages removed from its start.
+type detachedBuild struct {
+	mu      sync.Mutex
+	log     [][]byte
+	size    int
+	dropped int
+	done    bool
+	changed chan struct{}
+}
+
+func newDetachedBuilds() *detachedBuilds {
+	return &detachedBuilds{
+		builds: map[string]*detachedBuild{},
+	}
+}
+
+// buildID identifies a build by the build key, the build arguments and the context.
+// The tenant and the registry credentials are part of the ID, clients only attach
+// to builds pushing with their own credentials.
+func buildID(key string, r *http.Request, contextHash hash.Hash) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n%s\n%x", key, requestTenant(r), r.Header.Get("X-Registry-Config"), r.URL.Query().Encode(), contextHash.Sum(nil))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// start runs the build unless a build with the same ID is running or succeeded recently.
+// Failed builds are forgotten right away, retrying them starts a new build.
+// It reports if a new build was started.
+// Like attached builds it has no deadline of its own, the job times out once it runs.
+func (d *detachedBuilds) start(id string, build func(ctx context.Context, w io.Writer) error) (*detachedBuild, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	b, ok := d.builds[id]
+	if ok {
+		return b, false
+	}
+
+	b = &detachedBuild{
+		changed: make(chan struct{}),
+	}
+	d.builds[id] = b
+
+	go func() {
+		err := build(context.Background(), b)
+		if err != nil {
+			log.Printf("detached build %s: %v", id, err)
+		}
+
+		b.finish()
+
+		if err == nil {
+			time.Sleep(detachedBuildRetention)
+		}
+
+		d.mu.Lock()
+		delete(d.builds, id)
+		d.mu.Unlock()
+	}()
+
+	return b, true
+}
+
+func (b *detachedBuild) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.log = append(b.log, append([]byte{}, p...))
+	b.size += len(p)
+
+	for b.size > detachedLogLimit && len(b.log) > 1 {
+		b.size -= len(b.log[0])
+		b.log = b.log[1:]
+		b.dropped++
+	}
+
+	b.broadcast()
+
+	return len(p), nil
+}
+
+// Flush is a no-op, attached clients are flushed on every write.
+func (b *detachedBuild) Flush() {}
+
+func (b *detachedBuild) finish() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.done = true
+	b.broadcast()
+}
+
+func (b *detachedBuild) broadcast() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// attach replays the build output and follows it until the build finished
+// or the client disconnected.
+func (b *detachedBuild) attach(ctx context.Context, w http.ResponseWriter) error {
+	next := 0
+
+	for {
+		b.mu.Lock()
+		skipped := next < b.dropped
+		if skipped {
+			next = b.dropped
+		}
+		messages := b.log[next-b.dropped:]
+		done := b.done
+		changed := b.changed
+		b.mu.Unlock()
+
+		if skipped {
+			_, err := output{w: w}.Write([]byte("earlier output of the build was dropped\n"))
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, message := range messages {
+			_, err := w.Write(message)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(messages) > 0 {
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+
+			next += len(messages)
+		}
+
+		if done {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+func (s Service) detachedBuild(w http.ResponseWriter, r *http.Request, cfg *buildConfig, key string) {
+	contextHash := sha256.New()
+
+	err := s.storeContext(r.Context(), io.TeeReader(r.Body, contextHash), cfg)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("store context: %v", err)))
+		log.Printf("store context: %v", err)
+		return
+	}
+
+	id := buildID(key, r, contextHash)
+
+	b, started := s.detached.start(id, func(ctx context.Context, w io.Writer) error {
+		defer s.deleteContext(cfg)
+
+		return s.executeBuild(ctx, cfg, w)
+	})
+	if !started {
+		log.Printf("reattach to build %s", id)
+		s.deleteContext(cfg)
+	}
+
+	w.Header().Set(buildIDHeader, id)
+
+	err = b.attach(r.Context(), w)
+	if err != nil {
+		log.Printf("attach to build %s: %v", id, err)
+	}
+}
+
+func (s Service) deleteContext(cfg *buildConfig) {
+	defer s.inflight.remove(cfg.contextFilePath)
+	for _, key := range cfg.contextChunks {
+		defer s.inflight.remove(key)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := s.contexts.deleteContext(ctx, cfg)
+	if err != nil {
+		log.Printf("delete context %s: %v", cfg.contextFilePath, err)
+	}
+}
+
+// storeContext uploads the build context and keeps it from being garbage collected
+// until deleteContext is called.
+func (s Service) storeContext(ctx context.Context, r io.Reader, cfg *buildConfig) error {
+	err := s.contexts.storeContext(ctx, r, cfg, s.inflight, s.config().ContextChunkTTL.Duration)
+	if err != nil {
+		return err
+	}
+
+	s.inflight.add(cfg.contextFilePath)
+
+	return nil
+}
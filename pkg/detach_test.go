@@ -0,0 +1,143 @@
+package wedding
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_detachedBuilds(t *testing.T) {
+	d := newDetachedBuilds()
+
+	release := make(chan struct{})
+
+	b, started := d.start("a", func(ctx context.Context, w io.Writer) error {
+		w.Write([]byte(`{"stream": "step 1\n"}`))
+		<-release
+		w.Write([]byte(`{"aux":{"ID":"sha256:0d3cc5d5b92a"}}`))
+		return nil
+	})
+	if !started {
+		t.Fatalf("start() did not start the build")
+	}
+
+	again, started := d.start("a", func(ctx context.Context, w io.Writer) error {
+		t.Errorf("build started twice")
+		return nil
+	})
+	if started || again != b {
+		t.Fatalf("start() did not reattach to the running build")
+	}
+
+	close(release)
+
+	want := `{"stream": "step 1\n"}{"aux":{"ID":"sha256:0d3cc5d5b92a"}}`
+
+	for _, name := range []string{"first client", "second client"} {
+		w := httptest.NewRecorder()
+
+		err := b.attach(context.Background(), w)
+		if err != nil {
+			t.Errorf("%s: attach() error = %v", name, err)
+		}
+
+		if got := w.Body.String(); got != want {
+			t.Errorf("%s: attach() = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func Test_detachedBuilds_retryFailed(t *testing.T) {
+	d := newDetachedBuilds()
+
+	b, _ := d.start("a", func(ctx context.Context, w io.Writer) error {
+		return errors.New("build failed")
+	})
+
+	err := b.attach(context.Background(), httptest.NewRecorder())
+	if err != nil {
+		t.Fatalf("attach() error = %v", err)
+	}
+
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		_, started := d.start("a", func(ctx context.Context, w io.Writer) error {
+			return nil
+		})
+		if started {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("start() reattached to the failed build instead of retrying it")
+		}
+	}
+}
+
+func Test_detachedBuild_logLimit(t *testing.T) {
+	b := &detachedBuild{changed: make(chan struct{})}
+
+	message := bytes.Repeat([]byte("a"), detachedLogLimit/2)
+	b.Write([]byte("first"))
+	b.Write(message)
+	b.Write(message)
+	b.finish()
+
+	if b.size > detachedLogLimit {
+		t.Errorf("log keeps %d bytes, want at most %d", b.size, detachedLogLimit)
+	}
+
+	w := httptest.NewRecorder()
+
+	err := b.attach(context.Background(), w)
+	if err != nil {
+		t.Fatalf("attach() error = %v", err)
+	}
+
+	got := w.Body.String()
+	if !strings.HasPrefix(got, `{"stream": "earlier output of the build was dropped\n"}`) {
+		t.Errorf("attach() does not report the dropped output: %.80s", got)
+	}
+	if strings.Contains(got, "first") {
+		t.Errorf("attach() replays dropped output")
+	}
+	if !strings.HasSuffix(got, string(message)+string(message)) {
+		t.Errorf("attach() does not replay the latest output")
+	}
+}
+
+func Test_buildID(t *testing.T) {
+	request := func(tenant, registryConfig string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/build?t=app", nil)
+		r.Header.Set(tenantHeader, tenant)
+		r.Header.Set("X-Registry-Config", registryConfig)
+		return r
+	}
+
+	contextHash := sha256.New()
+	contextHash.Write([]byte("context"))
+
+	id := buildID("pipeline-1234", request("team-a", "credentials-a"), contextHash)
+
+	tests := []struct {
+		name string
+		r    *http.Request
+		same bool
+	}{
+		{name: "same", r: request("team-a", "credentials-a"), same: true},
+		{name: "other tenant", r: request("team-b", "credentials-a")},
+		{name: "other credentials", r: request("team-a", "credentials-b")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := buildID("pipeline-1234", tt.r, contextHash); (got == id) != tt.same {
+				t.Errorf("buildID() = %v, same as %v is %v, want %v", got, id, got == id, tt.same)
+			}
+		})
+	}
+}
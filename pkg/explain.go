@@ -0,0 +1,162 @@
+package wedding
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+var errJobFailed = errors.New("job failed")
+
+// exitError is the failure of a container with its exit code.
+type exitError struct {
+	code    int
+	message string
+}
+
+func (e exitError) Error() string {
+	return e.message
+}
+
+// exitCode returns the exit code of a failed container, or 1 for other errors.
+func exitCode(err error) int {
+	var exit exitError
+	if errors.As(err, &exit) && exit.code != 0 {
+		return exit.code
+	}
+
+	return 1
+}
+
+// podExitCode returns the exit code of the first failed container.
+func podExitCode(pod *corev1.Pod) int {
+	for _, status := range pod.Status.ContainerStatuses {
+		terminated := status.State.Terminated
+		if terminated != nil && terminated.ExitCode != 0 {
+			return int(terminated.ExitCode)
+		}
+	}
+
+	return 1
+}
+
+// podFailure explains why a pod failed in terms of the docker client.
+// It returns an empty string when the pod has not failed.
+func podFailure(kind string, pod *corev1.Pod) string {
+	if pod.Status.Reason == "Evicted" {
+		if strings.Contains(pod.Status.Message, "ephemeral local storage") || strings.Contains(pod.Status.Message, "EmptyDir volume") {
+			return fmt.Sprintf("%s exceeded disk space limit of %s (evicted)", kind, scratchLimit(pod))
+		}
+
+		return fmt.Sprintf("%s pod was evicted: %s", kind, pod.Status.Message)
+	}
+
+	for _, status := range pod.Status.ContainerStatuses {
+		terminated := status.State.Terminated
+		if terminated == nil || terminated.ExitCode == 0 {
+			continue
+		}
+
+		if terminated.Reason == "OOMKilled" {
+			return fmt.Sprintf("%s exceeded memory limit of %s (OOMKilled)", kind, memoryLimit(pod, status.Name))
+		}
+
+		// timeout exits with 124 when the maximum execution time is reached
+		if terminated.ExitCode == 124 {
+			return fmt.Sprintf("%s exceeded the maximum execution time", kind)
+		}
+
+		message := fmt.Sprintf("%s failed with exit code %d", kind, terminated.ExitCode)
+		if terminated.Reason != "" && terminated.Reason != "Error" {
+			message += fmt.Sprintf(" (%s)", terminated.Reason)
+		}
+		if terminated.Message != "" {
+			message += fmt.Sprintf(": %s", strings.TrimSpace(terminated.Message))
+		}
+
+		return message
+	}
+
+	if pod.Status.Phase == corev1.PodFailed {
+		return fmt.Sprintf("%s pod failed: %s %s", kind, pod.Status.Reason, pod.Status.Message)
+	}
+
+	return ""
+}
+
+// podPending explains why a pod does not start.
+func podPending(pod *corev1.Pod) string {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type != corev1.PodScheduled || condition.Status != corev1.ConditionFalse {
+			continue
+		}
+
+		switch {
+		case strings.Contains(condition.Message, "Insufficient cpu"):
+			return fmt.Sprintf("no node can fit %s CPU", podRequest(pod, corev1.ResourceCPU))
+		case strings.Contains(condition.Message, "Insufficient memory"):
+			return fmt.Sprintf("no node can fit %s memory", podRequest(pod, corev1.ResourceMemory))
+		}
+
+		return fmt.Sprintf("pod can not be scheduled: %s", condition.Message)
+	}
+
+	if message := podStartFailure(pod); message != "" {
+		return message
+	}
+
+	for _, status := range pod.Status.ContainerStatuses {
+		waiting := status.State.Waiting
+		if waiting == nil || waiting.Reason == "ContainerCreating" {
+			continue
+		}
+
+		return fmt.Sprintf("container %s is waiting: %s: %s", status.Name, waiting.Reason, waiting.Message)
+	}
+
+	return "pod did not start"
+}
+
+// podStartFailure explains why a container of the pod will never start.
+// It returns an empty string when the pod may still start.
+func podStartFailure(pod *corev1.Pod) string {
+	statuses := []corev1.ContainerStatus{}
+	statuses = append(statuses, pod.Status.InitContainerStatuses...)
+	statuses = append(statuses, pod.Status.ContainerStatuses...)
+
+	for _, status := range statuses {
+		waiting := status.State.Waiting
+		if waiting == nil {
+			continue
+		}
+
+		switch waiting.Reason {
+		case "ImagePullBackOff", "ErrImagePull", "InvalidImageName", "ErrImageNeverPull":
+			return fmt.Sprintf("%s for %s", waiting.Reason, status.Image)
+		}
+	}
+
+	return ""
+}
+
+func memoryLimit(pod *corev1.Pod, container string) string {
+	for _, c := range pod.Spec.Containers {
+		if c.Name == container {
+			return c.Resources.Limits.Memory().String()
+		}
+	}
+
+	return "unknown"
+}
+
+func podRequest(pod *corev1.Pod, name corev1.ResourceName) string {
+	for _, c := range pod.Spec.Containers {
+		if quantity, ok := c.Resources.Requests[name]; ok {
+			return quantity.String()
+		}
+	}
+
+	return "the requested"
+}
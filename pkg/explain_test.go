@@ -0,0 +1,223 @@
+package wedding
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func explainedPod(status corev1.PodStatus) *corev1.Pod {
+	return &corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "buildkit",
+					Resources: corev1.ResourceRequirements{
+						Limits: corev1.ResourceList{
+							corev1.ResourceMemory:           resource.MustParse("2Gi"),
+							corev1.ResourceEphemeralStorage: resource.MustParse("10Gi"),
+						},
+						Requests: corev1.ResourceList{
+							corev1.ResourceCPU:    resource.MustParse("8000m"),
+							corev1.ResourceMemory: resource.MustParse("2Gi"),
+						},
+					},
+				},
+			},
+		},
+		Status: status,
+	}
+}
+
+func terminated(exitCode int32, reason string) []corev1.ContainerStatus {
+	return []corev1.ContainerStatus{
+		{
+			Name:  "buildkit",
+			State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: exitCode, Reason: reason}},
+		},
+	}
+}
+
+func Test_podFailure(t *testing.T) {
+	tests := []struct {
+		name   string
+		status corev1.PodStatus
+		want   string
+	}{
+		{
+			name:   "oom",
+			status: corev1.PodStatus{Phase: corev1.PodFailed, ContainerStatuses: terminated(137, "OOMKilled")},
+			want:   "build exceeded memory limit of 2Gi (OOMKilled)",
+		},
+		{
+			name:   "exit code",
+			status: corev1.PodStatus{Phase: corev1.PodFailed, ContainerStatuses: terminated(1, "Error")},
+			want:   "build failed with exit code 1",
+		},
+		{
+			name:   "timeout",
+			status: corev1.PodStatus{Phase: corev1.PodFailed, ContainerStatuses: terminated(124, "Error")},
+			want:   "build exceeded the maximum execution time",
+		},
+		{
+			name:   "evicted",
+			status: corev1.PodStatus{Phase: corev1.PodFailed, Reason: "Evicted", Message: "The node was low on resource: memory."},
+			want:   "build pod was evicted: The node was low on resource: memory.",
+		},
+		{
+			name:   "disk space",
+			status: corev1.PodStatus{Phase: corev1.PodFailed, Reason: "Evicted", Message: "Pod ephemeral local storage usage exceeds the total limit of containers 10Gi. "},
+			want:   "build exceeded disk space limit of 10Gi (evicted)",
+		},
+		{
+			name:   "succeeded",
+			status: corev1.PodStatus{Phase: corev1.PodSucceeded, ContainerStatuses: terminated(0, "Completed")},
+			want:   "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := podFailure(buildOperation, explainedPod(tt.status)); got != tt.want {
+				t.Errorf("podFailure() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_podPending(t *testing.T) {
+	unschedulable := func(message string) []corev1.PodCondition {
+		return []corev1.PodCondition{
+			{Type: corev1.PodScheduled, Status: corev1.ConditionFalse, Reason: "Unschedulable", Message: message},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		status corev1.PodStatus
+		want   string
+	}{
+		{
+			name:   "cpu",
+			status: corev1.PodStatus{Conditions: unschedulable("0/3 nodes are available: 3 Insufficient cpu.")},
+			want:   "no node can fit 8 CPU",
+		},
+		{
+			name:   "memory",
+			status: corev1.PodStatus{Conditions: unschedulable("0/3 nodes are available: 3 Insufficient memory.")},
+			want:   "no node can fit 2Gi memory",
+		},
+		{
+			name:   "taint",
+			status: corev1.PodStatus{Conditions: unschedulable("0/3 nodes are available: 3 node(s) had taint {builds: }.")},
+			want:   "pod can not be scheduled: 0/3 nodes are available: 3 node(s) had taint {builds: }.",
+		},
+		{
+			name: "image pull",
+			status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{
+				{
+					Name:  "buildkit",
+					Image: "moby/buildkit:v0.9.3-rootless",
+					State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff"}},
+				},
+			}},
+			want: "ImagePullBackOff for moby/buildkit:v0.9.3-rootless",
+		},
+		{
+			name:   "unknown",
+			status: corev1.PodStatus{Phase: corev1.PodPending},
+			want:   "pod did not start",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := podPending(explainedPod(tt.status)); got != tt.want {
+				t.Errorf("podPending() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_podStartFailure(t *testing.T) {
+	waiting := func(reason string) []corev1.ContainerStatus {
+		return []corev1.ContainerStatus{
+			{
+				Name:  "buildkit",
+				Image: "moby/buildkit:v0.9.3-rootless",
+				State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: reason}},
+			},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		status corev1.PodStatus
+		want   string
+	}{
+		{
+			name:   "image pull back off",
+			status: corev1.PodStatus{ContainerStatuses: waiting("ImagePullBackOff")},
+			want:   "ImagePullBackOff for moby/buildkit:v0.9.3-rootless",
+		},
+		{
+			name:   "invalid image name",
+			status: corev1.PodStatus{ContainerStatuses: waiting("InvalidImageName")},
+			want:   "InvalidImageName for moby/buildkit:v0.9.3-rootless",
+		},
+		{
+			name:   "init container",
+			status: corev1.PodStatus{InitContainerStatuses: waiting("ErrImagePull")},
+			want:   "ErrImagePull for moby/buildkit:v0.9.3-rootless",
+		},
+		{
+			name:   "creating",
+			status: corev1.PodStatus{ContainerStatuses: waiting("ContainerCreating")},
+			want:   "",
+		},
+		{
+			name:   "pending",
+			status: corev1.PodStatus{Phase: corev1.PodPending},
+			want:   "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := podStartFailure(explainedPod(tt.status)); got != tt.want {
+				t.Errorf("podStartFailure() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_exitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{
+			name: "container",
+			err:  exitError{code: podExitCode(explainedPod(corev1.PodStatus{ContainerStatuses: terminated(2, "Error")})), message: "build failed with exit code 2"},
+			want: 2,
+		},
+		{
+			name: "wrapped",
+			err:  fmt.Errorf("execute job: %w", exitError{code: 137, message: "build exceeded memory limit of 2Gi (OOMKilled)"}),
+			want: 137,
+		},
+		{
+			name: "other",
+			err:  errors.New("create job: forbidden"),
+			want: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(tt.err); got != tt.want {
+				t.Errorf("exitCode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
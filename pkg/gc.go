@@ -0,0 +1,325 @@
+package wedding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const dockerConfigSecretPrefix = "wedding-docker-config-"
+
+// inflight tracks the kubernetes resources and contexts owned by running requests.
+type inflight struct {
+	mu    sync.Mutex
+	names map[string]int
+}
+
+func newInflight() *inflight {
+	return &inflight{
+		names: map[string]int{},
+	}
+}
+
+func (i *inflight) add(name string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.names[name]++
+}
+
+func (i *inflight) remove(name string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.names[name]--
+	if i.names[name] <= 0 {
+		delete(i.names, name)
+	}
+}
+
+func (i *inflight) contains(name string) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.names[name] > 0
+}
+
+// garbageReport counts the resources removed by a garbage collection.
+type garbageReport struct {
+	jobs     int
+	pods     int
+	secrets  int
+	contexts int
+	chunks   int
+}
+
+func (r garbageReport) String() string {
+	return fmt.Sprintf("%d jobs, %d pods, %d secrets, %d contexts, %d chunks", r.jobs, r.pods, r.secrets, r.contexts, r.chunks)
+}
+
+// CollectGarbage removes jobs, pods and secrets not owned by a running request
+// once they are older than ttl, build contexts older than the maximum execution time
+// and context chunks not used for the chunk ttl.
+// It runs right away and then every interval until the service is closed.
+func (s Service) CollectGarbage(interval, ttl time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+
+		report, err := s.collectGarbage(ctx, ttl)
+		if err != nil {
+			log.Printf("garbage collection: %v", err)
+		}
+
+		config := s.config()
+
+		report.contexts, report.chunks, err = s.contexts.collectGarbage(ctx, s.inflight, config.LongestTimeout(), config.ContextChunkTTL.Duration)
+		if err != nil {
+			log.Printf("garbage collection: %v", err)
+		}
+		if report != (garbageReport{}) {
+			log.Printf("garbage collection removed %s", report)
+		}
+
+		cancel()
+
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// collectGarbage removes jobs, pods and secrets not owned by a running request and older than ttl
+// from all targets.
+func (s Service) collectGarbage(ctx context.Context, ttl time.Duration) (garbageReport, error) {
+	report := garbageReport{}
+	failed := []string{}
+
+	for _, t := range s.targets {
+		err := s.collectTargetGarbage(ctx, t, ttl, &report)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("target %s: %v", t.Name, err))
+		}
+	}
+
+	if len(failed) != 0 {
+		return report, errors.New(strings.Join(failed, ", "))
+	}
+
+	return report, nil
+}
+
+func (s Service) collectTargetGarbage(ctx context.Context, t *target, ttl time.Duration, report *garbageReport) error {
+	expired := metav1.NewTime(time.Now().Add(-ttl))
+	propagation := metav1.DeletePropagationBackground
+	selector := metav1.ListOptions{LabelSelector: "app=wedding"}
+
+	jobClient := t.Client.BatchV1().Jobs(t.Namespace)
+
+	jobs, err := jobClient.List(ctx, selector)
+	if err != nil {
+		return fmt.Errorf("list jobs: %v", err)
+	}
+
+	for _, job := range jobs.Items {
+		if s.inflight.contains(job.Name) || !job.CreationTimestamp.Before(&expired) {
+			continue
+		}
+
+		err = jobClient.Delete(ctx, job.Name, metav1.DeleteOptions{PropagationPolicy: &propagation})
+		if err != nil {
+			log.Printf("garbage collection: delete job %s: %v", job.Name, err)
+			continue
+		}
+
+		log.Printf("garbage collection: deleted job %s", job.Name)
+		report.jobs++
+	}
+
+	podClient := t.Client.CoreV1().Pods(t.Namespace)
+
+	pods, err := podClient.List(ctx, selector)
+	if err != nil {
+		return fmt.Errorf("list pods: %v", err)
+	}
+
+	for _, pod := range pods.Items {
+		if s.inflight.contains(pod.Labels[jobNameLabel]) || !pod.CreationTimestamp.Before(&expired) {
+			continue
+		}
+
+		err = podClient.Delete(ctx, pod.Name, metav1.DeleteOptions{})
+		if err != nil {
+			log.Printf("garbage collection: delete pod %s: %v", pod.Name, err)
+			continue
+		}
+
+		log.Printf("garbage collection: deleted pod %s", pod.Name)
+		report.pods++
+	}
+
+	secretClient := t.Client.CoreV1().Secrets(t.Namespace)
+
+	secrets, err := secretClient.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("list secrets: %v", err)
+	}
+
+	for _, secret := range secrets.Items {
+		// secrets owned by a job are removed by kubernetes together with the job
+		if !strings.HasPrefix(secret.Name, dockerConfigSecretPrefix) ||
+			len(secret.OwnerReferences) != 0 ||
+			s.inflight.contains(secret.Name) ||
+			!secret.CreationTimestamp.Before(&expired) {
+			continue
+		}
+
+		err = secretClient.Delete(ctx, secret.Name, metav1.DeleteOptions{})
+		if err != nil {
+			log.Printf("garbage collection: delete secret %s: %v", secret.Name, err)
+			continue
+		}
+
+		log.Printf("garbage collection: deleted secret %s", secret.Name)
+		report.secrets++
+	}
+
+	return nil
+}
+
+// collectGarbage deletes build contexts older than maxAge and chunks older than chunkTTL
+// no manifest of a context references.
+// Only objects below the prefixes of wedding are touched, the bucket may be shared.
+// The inflight contexts are only known for this replica, the age keeps contexts
+// other replicas use: chunk lists are written when the build starts and are
+// not used for longer than the maximum execution time.
+// Manifests are deleted with their context, the ones left behind expire with the chunk ttl.
+func (o ObjectStore) collectGarbage(ctx context.Context, inflight *inflight, maxAge, chunkTTL time.Duration) (int, int, error) {
+	now := time.Now()
+
+	contextKeys, err := o.listExpired(ctx, contextPrefix, now.Add(-maxAge), inflight)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	manifestKeys, err := o.listExpired(ctx, manifestPrefix, now.Add(-chunkTTL), inflight)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	chunkKeys, err := o.listExpired(ctx, chunkPrefix, now.Add(-chunkTTL), inflight)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// manifests are read after listing the chunks, a context stored in between
+	// only uses chunks renewed after the listing
+	referenced, err := o.referencedChunks(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	contexts, chunks := 0, 0
+
+	for _, key := range append(contextKeys, manifestKeys...) {
+		err = o.deleteObject(ctx, key)
+		if err != nil {
+			log.Printf("garbage collection: delete context %s: %v", key, err)
+			continue
+		}
+
+		if strings.HasPrefix(key, manifestPrefix) {
+			continue
+		}
+
+		log.Printf("garbage collection: deleted context %s", key)
+		contexts++
+	}
+
+	for _, key := range chunkKeys {
+		// a new build might have started to use the chunk since listing it
+		if inflight.contains(key) || referenced[key] {
+			continue
+		}
+
+		renewed, err := o.modifiedSince(ctx, key, now.Add(-chunkTTL))
+		if err != nil {
+			log.Printf("garbage collection: delete chunk %s: %v", key, err)
+			continue
+		}
+		if renewed {
+			continue
+		}
+
+		err = o.deleteObject(ctx, key)
+		if err != nil {
+			log.Printf("garbage collection: delete chunk %s: %v", key, err)
+			continue
+		}
+
+		chunks++
+	}
+
+	return contexts, chunks, nil
+}
+
+func (o ObjectStore) deleteObject(ctx context.Context, key string) error {
+	_, err := o.Client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(o.Bucket),
+		Key:    aws.String(key),
+	})
+
+	return err
+}
+
+// modifiedSince checks if an object was uploaded again since it was listed.
+func (o ObjectStore) modifiedSince(ctx context.Context, key string, since time.Time) (bool, error) {
+	head, err := o.Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(o.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return !aws.TimeValue(head.LastModified).Before(since), nil
+}
+
+// listExpired lists the objects below prefix last modified before expired
+// and not inflight.
+func (o ObjectStore) listExpired(ctx context.Context, prefix string, expired time.Time, inflight *inflight) ([]string, error) {
+	keys := []string{}
+
+	err := o.Client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(o.Bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			key := aws.StringValue(object.Key)
+
+			if inflight.contains(key) || !aws.TimeValue(object.LastModified).Before(expired) {
+				continue
+			}
+
+			keys = append(keys, key)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list %s: %v", prefix, err)
+	}
+
+	return keys, nil
+}
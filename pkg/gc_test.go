@@ -0,0 +1,98 @@
+package wedding
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_collectGarbage(t *testing.T) {
+	old := metav1.NewTime(time.Now().Add(-2 * time.Hour))
+	recent := metav1.NewTime(time.Now())
+
+	meta := func(name string, created metav1.Time, labels map[string]string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         "default",
+			CreationTimestamp: created,
+			Labels:            labels,
+		}
+	}
+	wedding := map[string]string{"app": "wedding"}
+
+	client := fake.NewSimpleClientset([]runtime.Object{
+		&batchv1.Job{ObjectMeta: meta("wedding-build-orphan", old, wedding)},
+		&batchv1.Job{ObjectMeta: meta("wedding-build-running", old, wedding)},
+		&batchv1.Job{ObjectMeta: meta("wedding-build-recent", recent, wedding)},
+		&batchv1.Job{ObjectMeta: meta("unrelated", old, nil)},
+		&corev1.Pod{ObjectMeta: meta("wedding-build-orphan-abcde", old, map[string]string{"app": "wedding", jobNameLabel: "wedding-build-orphan"})},
+		&corev1.Pod{ObjectMeta: meta("wedding-build-running-abcde", old, map[string]string{"app": "wedding", jobNameLabel: "wedding-build-running"})},
+		&corev1.Secret{ObjectMeta: meta("wedding-docker-config-orphan", old, nil)},
+		&corev1.Secret{ObjectMeta: meta("wedding-docker-config-running", old, nil)},
+		&corev1.Secret{ObjectMeta: meta("wedding-docker-config-recent", recent, nil)},
+		&corev1.Secret{ObjectMeta: meta("unrelated", old, nil)},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+			Name:              "wedding-docker-config-owned",
+			Namespace:         "default",
+			CreationTimestamp: old,
+			OwnerReferences:   []metav1.OwnerReference{{Kind: "Job", Name: "wedding-build-recent"}},
+		}},
+	}...)
+
+	s := Service{
+		targets:  []*target{{Target: Target{Name: "default", Namespace: "default", Client: client}}},
+		inflight: newInflight(),
+	}
+	s.inflight.add("wedding-build-running")
+	s.inflight.add("wedding-docker-config-running")
+
+	ctx := context.Background()
+
+	report, err := s.collectGarbage(ctx, time.Hour)
+	if err != nil {
+		t.Fatalf("collectGarbage() error = %v", err)
+	}
+
+	wantReport := garbageReport{jobs: 1, pods: 1, secrets: 1}
+	if report != wantReport {
+		t.Errorf("collectGarbage() = %v, want %v", report, wantReport)
+	}
+
+	names := []string{}
+
+	jobs, _ := client.BatchV1().Jobs("default").List(ctx, metav1.ListOptions{})
+	for _, job := range jobs.Items {
+		names = append(names, "job/"+job.Name)
+	}
+	pods, _ := client.CoreV1().Pods("default").List(ctx, metav1.ListOptions{})
+	for _, pod := range pods.Items {
+		names = append(names, "pod/"+pod.Name)
+	}
+	secrets, _ := client.CoreV1().Secrets("default").List(ctx, metav1.ListOptions{})
+	for _, secret := range secrets.Items {
+		names = append(names, "secret/"+secret.Name)
+	}
+	sort.Strings(names)
+
+	want := []string{
+		"job/unrelated",
+		"job/wedding-build-recent",
+		"job/wedding-build-running",
+		"pod/wedding-build-running-abcde",
+		"secret/unrelated",
+		"secret/wedding-docker-config-owned",
+		"secret/wedding-docker-config-recent",
+		"secret/wedding-docker-config-running",
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("remaining resources = %v, want %v", names, want)
+	}
+}
@@ -0,0 +1,135 @@
+package wedding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	errAmbiguous = errors.New("image ID prefix is ambiguous")
+
+	imageIDPattern = regexp.MustCompile(`^(sha256:)?[a-f0-9]{1,64}$`)
+)
+
+// imageIDRepo holds a tag named after the image ID of every image built by wedding.
+// Docker clients refer to images by the image ID, the digest of the image config,
+// while the registry stores them by the digest of the manifest.
+// Keeping the mapping in the registry survives restarts and is shared between replicas.
+const imageIDRepo = "digests"
+
+// tagImageID tags the image manifest with the hex of its image ID.
+func (s Service) tagImageID(ctx context.Context, repo, digest, id string) error {
+	r := s.localRegistry()
+
+	m, err := r.getManifest(ctx, repo, digest)
+	if err != nil {
+		return err
+	}
+
+	return r.copyManifest(ctx, repo, imageIDRepo, strings.TrimPrefix(id, "sha256:"), m)
+}
+
+// searchImageID looks up the tag of an image by its ID or a unique prefix of it.
+func (s Service) searchImageID(ctx context.Context, prefix string) (string, error) {
+	tags, err := s.localRegistry().listTags(ctx, imageIDRepo)
+	if err != nil {
+		return "", err
+	}
+
+	return matchImageID(tags, strings.TrimPrefix(prefix, "sha256:"))
+}
+
+func matchImageID(tags []string, prefix string) (string, error) {
+	match := ""
+
+	for _, tag := range tags {
+		if !imageIDPattern.MatchString(tag) || !strings.HasPrefix(tag, prefix) {
+			continue
+		}
+
+		if tag == prefix {
+			return tag, nil
+		}
+
+		if match != "" {
+			return "", errAmbiguous
+		}
+
+		match = tag
+	}
+
+	if match == "" {
+		return "", errNotFound
+	}
+
+	return match, nil
+}
+
+// resolveImage returns the repository and reference of an image in the local registry.
+// Like dockerd, image names take precedence over image ID prefixes.
+func (s Service) resolveImage(ctx context.Context, name string) (string, string, error) {
+	repo, tag := localImage(name)
+
+	if !imageIDPattern.MatchString(name) {
+		return repo, tag, nil
+	}
+
+	if !strings.HasPrefix(name, "sha256:") {
+		exists, err := s.localRegistry().manifestExists(ctx, repo, tag)
+		if err != nil {
+			return "", "", err
+		}
+
+		if exists {
+			return repo, tag, nil
+		}
+	}
+
+	id, err := s.searchImageID(ctx, name)
+	if err != nil {
+		return "", "", fmt.Errorf("image %s: %w", name, err)
+	}
+
+	return imageIDRepo, id, nil
+}
+
+// lookupImage resolves an image name or ID and fetches its manifest from the local registry.
+func (s Service) lookupImage(ctx context.Context, name string) (string, *manifest, error) {
+	repo, reference, err := s.resolveImage(ctx, name)
+	if err != nil {
+		return "", nil, err
+	}
+
+	m, err := s.localRegistry().getManifest(ctx, repo, reference)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return repo, m, nil
+}
+
+// localReference formats the reference of an image in the local registry.
+func (s Service) localReference(repo, reference string) string {
+	host := s.config().Registry
+
+	if strings.HasPrefix(reference, "sha256:") {
+		return fmt.Sprintf("%s/%s@%s", host, repo, reference)
+	}
+
+	return fmt.Sprintf("%s/%s:%s", host, repo, reference)
+}
+
+// imageNotFound reports missing images the way dockerd does.
+func imageNotFound(err error, name string) (string, bool) {
+	switch {
+	case errors.Is(err, errAmbiguous):
+		return fmt.Sprintf("No such image: %s (%v)", name, errAmbiguous), true
+	case errors.Is(err, errNotFound):
+		return fmt.Sprintf("No such image: %s", name), true
+	}
+
+	return "", false
+}
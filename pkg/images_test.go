@@ -0,0 +1,59 @@
+package wedding
+
+import (
+	"errors"
+	"testing"
+)
+
+func Test_matchImageID(t *testing.T) {
+	tags := []string{
+		"latest",
+		"0d3cc5d5b92a708fbabb79b63b59839ca87012742a1b5e741cf51fd1ad14b804",
+		"0d3c9a1e6a1c2b0ba6f54de2d07fd57c5fe7e3a1a7be4cb9bb14d10e4bd4ea5c",
+	}
+
+	tests := []struct {
+		name    string
+		prefix  string
+		want    string
+		wantErr error
+	}{
+		{
+			name:   "full",
+			prefix: "0d3cc5d5b92a708fbabb79b63b59839ca87012742a1b5e741cf51fd1ad14b804",
+			want:   "0d3cc5d5b92a708fbabb79b63b59839ca87012742a1b5e741cf51fd1ad14b804",
+		},
+		{
+			name:   "short",
+			prefix: "0d3cc5d5b92a",
+			want:   "0d3cc5d5b92a708fbabb79b63b59839ca87012742a1b5e741cf51fd1ad14b804",
+		},
+		{
+			name:    "ambiguous",
+			prefix:  "0d3c",
+			wantErr: errAmbiguous,
+		},
+		{
+			name:    "missing",
+			prefix:  "ff",
+			wantErr: errNotFound,
+		},
+		{
+			name:    "not an id",
+			prefix:  "lat",
+			wantErr: errNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := matchImageID(tags, tt.prefix)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("matchImageID() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("matchImageID() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,45 +1,144 @@
 package wedding
 
 import (
-	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
-	"io"
 	"log"
-	"math/rand"
 	"net/http"
 
 	"github.com/gorilla/mux"
 )
 
+// imageConfig contains the fields of an image config blob docker reports on inspect.
+type imageConfig struct {
+	Architecture    string          `json:"architecture"`
+	Variant         string          `json:"variant,omitempty"`
+	OS              string          `json:"os"`
+	Created         string          `json:"created"`
+	Author          string          `json:"author"`
+	DockerVersion   string          `json:"docker_version"`
+	Config          json.RawMessage `json:"config"`
+	ContainerConfig json.RawMessage `json:"container_config"`
+	RootFS          struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// imageInspect follows the ImageInspect schema of the docker engine api.
+type imageInspect struct {
+	ID              string          `json:"Id"`
+	RepoTags        []string        `json:"RepoTags"`
+	RepoDigests     []string        `json:"RepoDigests"`
+	Parent          string          `json:"Parent"`
+	Comment         string          `json:"Comment"`
+	Created         string          `json:"Created"`
+	Container       string          `json:"Container"`
+	ContainerConfig json.RawMessage `json:"ContainerConfig"`
+	DockerVersion   string          `json:"DockerVersion"`
+	Author          string          `json:"Author"`
+	Config          json.RawMessage `json:"Config"`
+	Architecture    string          `json:"Architecture"`
+	Variant         string          `json:"Variant,omitempty"`
+	Os              string          `json:"Os"`
+	Size            int64           `json:"Size"`
+	VirtualSize     int64           `json:"VirtualSize"`
+	RootFS          inspectRootFS   `json:"RootFS"`
+}
+
+type inspectRootFS struct {
+	Type   string   `json:"Type"`
+	Layers []string `json:"Layers"`
+}
+
 func (s Service) inspect(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	image := fmt.Sprintf("wedding-registry:5000/images/%s", escapePort(vars["name"]))
-	randomID := randStringBytes(16)
-	script := fmt.Sprintf(`
-set -euo pipefail
-mkdir %s
-skopeo copy --quiet --retry-times 3 --src-tls-verify=false docker://%s dir://%s
-skopeo inspect dir://%s
-rm -r %s
-`, randomID, image, randomID, randomID, randomID)
-
-	o := &bytes.Buffer{}
-	err := s.runSkopeoPod(r.Context(), o, "inspect", script, "")
+
+	inspect, err := s.imageInspect(r.Context(), vars["name"])
+	if msg, ok := imageNotFound(err, vars["name"]); ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(msg))
+		return
+	}
 	if err != nil {
 		log.Printf("execute inspect: %v", err)
-		w.WriteHeader(http.StatusNotFound)
-		io.Copy(w, o)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("inspect image: %v", err)))
 		return
 	}
 
-	io.Copy(w, o)
+	w.Header().Set("Content-Type", "application/json")
+
+	err = json.NewEncoder(w).Encode(inspect)
+	if err != nil {
+		log.Printf("encode inspect: %v", err)
+	}
 }
 
-func randStringBytes(n int) string {
-	letterBytes := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
-	b := make([]byte, n)
-	for i := range b {
-		b[i] = letterBytes[rand.Intn(len(letterBytes))]
+func (s Service) imageInspect(ctx context.Context, name string) (*imageInspect, error) {
+	repo, m, err := s.lookupImage(ctx, name)
+	if err != nil {
+		return nil, err
 	}
-	return string(b)
+
+	_, content, err := s.localRegistry().imageManifest(ctx, repo, m, s.config().DefaultPlatform)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := s.localRegistry().getBlob(ctx, repo, content.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return newImageInspect(name, repo, m.digest, content, config)
+}
+
+// newImageInspect describes the image. Images found by their ID report no repository tags and digests.
+func newImageInspect(name, repo, repoDigest string, content *manifestContent, config []byte) (*imageInspect, error) {
+	cfg := imageConfig{}
+
+	err := json.Unmarshal(config, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("decode image config %s: %v", content.Config.Digest, err)
+	}
+
+	inspect := &imageInspect{
+		ID:              content.Config.Digest,
+		RepoTags:        []string{},
+		RepoDigests:     []string{},
+		Created:         cfg.Created,
+		ContainerConfig: cfg.ContainerConfig,
+		DockerVersion:   cfg.DockerVersion,
+		Author:          cfg.Author,
+		Config:          cfg.Config,
+		Architecture:    cfg.Architecture,
+		Variant:         cfg.Variant,
+		Os:              cfg.OS,
+		RootFS: inspectRootFS{
+			Type:   cfg.RootFS.Type,
+			Layers: cfg.RootFS.DiffIDs,
+		},
+	}
+
+	if repo != imageIDRepo {
+		image, tag := splitTag(name)
+		inspect.RepoTags = append(inspect.RepoTags, fmt.Sprintf("%s:%s", image, tag))
+		inspect.RepoDigests = append(inspect.RepoDigests, fmt.Sprintf("%s@%s", image, repoDigest))
+	}
+
+	for _, layer := range content.Layers {
+		inspect.Size += layer.Size
+	}
+	inspect.VirtualSize = inspect.Size
+
+	if inspect.Config == nil {
+		inspect.Config = json.RawMessage("{}")
+	}
+	if inspect.ContainerConfig == nil {
+		inspect.ContainerConfig = json.RawMessage("{}")
+	}
+
+	return inspect, nil
 }
@@ -0,0 +1,58 @@
+package wedding
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func Test_newImageInspect(t *testing.T) {
+	content := &manifestContent{
+		Config: descriptor{Digest: "sha256:0d3cc5d5b92a708fbabb79b63b59839ca87012742a1b5e741cf51fd1ad14b804"},
+		Layers: []descriptor{
+			{Digest: "sha256:166a2418f7e86fa48d87bf6807b4e5b35f078acb2ad1cbf10444a7025913c24f", Size: 2811},
+			{Digest: "sha256:1966ea362d2394e7c5c508ebf3695f039dd3825bd1e7a07449ae530aea3c4cd1", Size: 100},
+		},
+	}
+	config := `{"architecture":"amd64","os":"linux","created":"2021-05-20T10:00:00Z","config":{"Env":["PATH=/bin"]},"rootfs":{"type":"layers","diff_ids":["sha256:aa","sha256:bb"]}}`
+
+	tests := []struct {
+		name string
+		repo string
+		want string
+	}{
+		{
+			name: "alpine",
+			repo: "images/alpine",
+			want: `{"Id":"sha256:0d3cc5d5b92a708fbabb79b63b59839ca87012742a1b5e741cf51fd1ad14b804","RepoTags":["alpine:latest"],"RepoDigests":["alpine@sha256:3acb5d16e32a8cf7094e195a5d24ca15d4fbe8a433a8bd5cc2365040739eb2dc"],"Parent":"","Comment":"","Created":"2021-05-20T10:00:00Z","Container":"","ContainerConfig":{},"DockerVersion":"","Author":"","Config":{"Env":["PATH=/bin"]},"Architecture":"amd64","Os":"linux","Size":2911,"VirtualSize":2911,"RootFS":{"Type":"layers","Layers":["sha256:aa","sha256:bb"]}}`,
+		},
+		{
+			name: "sha256:0d3cc5d5b92a708fbabb79b63b59839ca87012742a1b5e741cf51fd1ad14b804",
+			repo: imageIDRepo,
+			want: `{"Id":"sha256:0d3cc5d5b92a708fbabb79b63b59839ca87012742a1b5e741cf51fd1ad14b804","RepoTags":[],"RepoDigests":[],"Parent":"","Comment":"","Created":"2021-05-20T10:00:00Z","Container":"","ContainerConfig":{},"DockerVersion":"","Author":"","Config":{"Env":["PATH=/bin"]},"Architecture":"amd64","Os":"linux","Size":2911,"VirtualSize":2911,"RootFS":{"Type":"layers","Layers":["sha256:aa","sha256:bb"]}}`,
+		},
+		{
+			name: "0d3cc5d5b92a",
+			repo: imageIDRepo,
+			want: `{"Id":"sha256:0d3cc5d5b92a708fbabb79b63b59839ca87012742a1b5e741cf51fd1ad14b804","RepoTags":[],"RepoDigests":[],"Parent":"","Comment":"","Created":"2021-05-20T10:00:00Z","Container":"","ContainerConfig":{},"DockerVersion":"","Author":"","Config":{"Env":["PATH=/bin"]},"Architecture":"amd64","Os":"linux","Size":2911,"VirtualSize":2911,"RootFS":{"Type":"layers","Layers":["sha256:aa","sha256:bb"]}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newImageInspect(tt.name, tt.repo, "sha256:3acb5d16e32a8cf7094e195a5d24ca15d4fbe8a433a8bd5cc2365040739eb2dc", content, []byte(config))
+			if err != nil {
+				t.Errorf("newImageInspect() error = %v", err)
+				return
+			}
+
+			b, err := json.Marshal(got)
+			if err != nil {
+				t.Errorf("encode inspect: %v", err)
+				return
+			}
+
+			if string(b) != tt.want {
+				t.Errorf("newImageInspect() = %s, want %s", b, tt.want)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package wedding
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -10,15 +11,26 @@ import (
 	"strconv"
 	"time"
 
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 )
 
-func (s Service) runSkopeoPod(ctx context.Context, w io.Writer, processName, script, dockerJSON string) error {
+func (s Service) runSkopeoJob(ctx context.Context, w io.Writer, op operation, script, dockerJSON string) error {
+	config := s.config()
+
+	release, err := enqueue(ctx, s.skopeoJobs, op, w)
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	pod := &corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
-			GenerateName: fmt.Sprintf("wedding-%s-", processName),
+			GenerateName: fmt.Sprintf("wedding-%s-", op.kind),
 			Labels: map[string]string{
 				"app": "wedding",
 				"job": "skopeo",
@@ -28,10 +40,10 @@ func (s Service) runSkopeoPod(ctx context.Context, w io.Writer, processName, scr
 			Containers: []corev1.Container{
 				{
 					Name:  "skopeo",
-					Image: skopeoImage,
+					Image: config.SkopeoImage,
 					Command: []string{
 						"timeout",
-						strconv.Itoa(int(MaxExecutionTime / time.Second)),
+						strconv.Itoa(int(config.timeout(op) / time.Second)),
 					},
 					Args: []string{
 						"sh",
@@ -40,12 +52,12 @@ func (s Service) runSkopeoPod(ctx context.Context, w io.Writer, processName, scr
 					},
 					Resources: corev1.ResourceRequirements{
 						Limits: corev1.ResourceList{
-							corev1.ResourceCPU:    resource.MustParse(skopeoCPU),
-							corev1.ResourceMemory: resource.MustParse(skopeoMemory),
+							corev1.ResourceCPU:    resource.MustParse(config.SkopeoCPU),
+							corev1.ResourceMemory: resource.MustParse(config.SkopeoMemory),
 						},
 						Requests: corev1.ResourceList{
-							corev1.ResourceCPU:    resource.MustParse(skopeoCPU),
-							corev1.ResourceMemory: resource.MustParse(skopeoMemory),
+							corev1.ResourceCPU:    resource.MustParse(config.SkopeoCPU),
+							corev1.ResourceMemory: resource.MustParse(config.SkopeoMemory),
 						},
 					},
 				},
@@ -54,39 +66,31 @@ func (s Service) runSkopeoPod(ctx context.Context, w io.Writer, processName, scr
 		},
 	}
 
+	var secret *corev1.Secret
+
 	if dockerJSON != "" {
-		secret := &corev1.Secret{
+		secret = &corev1.Secret{
 			ObjectMeta: metav1.ObjectMeta{
-				GenerateName: "wedding-docker-config-",
+				Name: op.secretName(),
 			},
 			StringData: map[string]string{
 				"config.json": dockerJSON,
 			},
 		}
 
-		secretClient := s.kubernetesClient.CoreV1().Secrets(s.namespace)
-
-		secret, err := secretClient.Create(ctx, secret, metav1.CreateOptions{})
-		if err != nil {
-			return fmt.Errorf("create docker.json secret: %v", err)
-		}
-		defer func() {
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-			defer cancel()
-
-			err = secretClient.Delete(ctx, secret.Name, metav1.DeleteOptions{})
-			if err != nil {
-				streamf(w, "Secret deletetion failed: %v\n", err)
-				log.Printf("delete secret: %v", err)
-			}
-		}()
-
+		// skopeo does not run as root, the config is read from outside its home
 		pod.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{
 			{
-				MountPath: "/root/.docker",
+				MountPath: "/etc/wedding/docker",
 				Name:      "docker-config",
 			},
 		}
+		pod.Spec.Containers[0].Env = []corev1.EnvVar{
+			{
+				Name:  "REGISTRY_AUTH_FILE",
+				Value: "/etc/wedding/docker/config.json",
+			},
+		}
 		pod.Spec.Volumes = []corev1.Volume{
 			{
 				Name: "docker-config",
@@ -99,22 +103,136 @@ func (s Service) runSkopeoPod(ctx context.Context, w io.Writer, processName, scr
 		}
 	}
 
-	return s.executePod(ctx, pod, w)
+	config.PodSecurity.secure(pod, "")
+
+	return s.executeJob(ctx, op, pod, secret, w)
 }
 
-func (s Service) executePod(ctx context.Context, pod *corev1.Pod, w io.Writer) error {
-	podClient := s.kubernetesClient.CoreV1().Pods(s.namespace)
+// executeJob runs the pod as a kubernetes job on the least loaded target accepting the operation.
+// Targets which can not be reached are skipped in favour of the next one.
+func (s Service) executeJob(ctx context.Context, op operation, pod *corev1.Pod, secret *corev1.Secret, w io.Writer) error {
+	targets, err := s.selectTargets(op)
+	if err != nil {
+		streamf(w, "Target selection failed: %v\n", err)
+		return err
+	}
+
+	for _, t := range targets {
+		err = s.runJob(ctx, t, op, pod.DeepCopy(), secret, w)
+		if !errors.Is(err, errTargetUnreachable) || ctx.Err() != nil {
+			return err
+		}
 
-	pod, err := podClient.Create(ctx, pod, metav1.CreateOptions{})
+		t.markUnreachable()
+		log.Printf("%s operation %s: %v", op.kind, op.id, err)
+		streamf(w, "Target %s is unreachable\n", t.Name)
+	}
+
+	return err
+}
+
+// runJob runs the pod as a kubernetes job on the target and streams the logs of its pods.
+// Pods failing before the backoff limit is reached are replaced by the job controller.
+// The optional secret is created for the job and owned by it, deleting the job
+// removes the secret with it.
+func (s Service) runJob(ctx context.Context, t *target, op operation, pod *corev1.Pod, secret *corev1.Secret, w io.Writer) error {
+	release := t.acquire()
+	defer release()
+
+	config := s.config()
+	activeDeadline := int64(config.timeout(op) / time.Second)
+	ttl := int32(s.jobTTL / time.Second)
+	backoffLimit := s.backoffLimit
+
+	pod.Labels = op.label(pod.Labels)
+
+	pod, err := s.applyPodTemplate(ctx, t, pod)
 	if err != nil {
-		return fmt.Errorf("create pod: %v", err)
+		streamf(w, "Pod template failed: %v\n", err)
+		return err
+	}
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: pod.GenerateName,
+			Labels:       pod.Labels,
+		},
+		Spec: batchv1.JobSpec{
+			ActiveDeadlineSeconds:   &activeDeadline,
+			TTLSecondsAfterFinished: &ttl,
+			BackoffLimit:            &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      pod.Labels,
+					Annotations: pod.Annotations,
+				},
+				Spec: pod.Spec,
+			},
+		},
+	}
+
+	secretClient := t.Client.CoreV1().Secrets(t.Namespace)
+	secretOwned := false
+
+	if secret != nil {
+		secret.Labels = op.label(map[string]string{"app": "wedding"})
+
+		_, err := secretClient.Create(ctx, secret, metav1.CreateOptions{})
+		if err != nil && isUnreachable(err) {
+			return fmt.Errorf("%w: %s: create secret: %v", errTargetUnreachable, t.Name, err)
+		}
+		if err != nil {
+			streamf(w, "Secret creation failed: %v\n", err)
+			return fmt.Errorf("create secret: %v", err)
+		}
+
+		s.inflight.add(secret.Name)
+		defer func() {
+			defer s.inflight.remove(secret.Name)
+
+			if secretOwned {
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			err := secretClient.Delete(ctx, secret.Name, metav1.DeleteOptions{})
+			if err != nil {
+				streamf(w, "Secret deletetion failed: %v\n", err)
+				log.Printf("delete secret: %v", err)
+			}
+		}()
+	}
+
+	jobClient := t.Client.BatchV1().Jobs(t.Namespace)
+
+	job, err = createJob(ctx, t, job, config.PodSecurity.HostUsers)
+	if err != nil && isUnreachable(err) {
+		return fmt.Errorf("%w: %s: create job: %v", errTargetUnreachable, t.Name, err)
+	}
+	if err != nil {
+		return fmt.Errorf("create job: %v", err)
+	}
+
+	log.Printf("%s operation %s runs as job %s on target %s", op.kind, op.id, job.Name, t.Name)
+
+	if secret != nil {
+		err = s.ownSecret(ctx, t, job, secret.Name)
+		if err != nil {
+			log.Printf("set owner of secret %s: %v", secret.Name, err)
+		} else {
+			secretOwned = true
+		}
 	}
 
 	failed := false
 
+	s.inflight.add(job.Name)
 	defer func() {
-		// helpful for development: remove all failed pods
-		// kubectl get po | grep -E 'wedding-(push|pull|tag|build)' | awk '{ print $1 }' | xargs kubectl delete po
+		defer s.inflight.remove(job.Name)
+
+		// failed jobs are kept for debugging until the garbage collection removes them
 		if failed && os.Getenv("KEEP_FAILED_PODS") != "" {
 			return
 		}
@@ -122,90 +240,204 @@ func (s Service) executePod(ctx context.Context, pod *corev1.Pod, w io.Writer) e
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 
-		err = podClient.Delete(ctx, pod.Name, metav1.DeleteOptions{})
+		// background propagation removes the pods and the owned secret as well
+		propagation := metav1.DeletePropagationBackground
+
+		err = jobClient.Delete(ctx, job.Name, metav1.DeleteOptions{PropagationPolicy: &propagation})
 		if err != nil {
-			log.Printf("delete pod %s: %v", pod.Name, err)
+			log.Printf("delete job %s: %v", job.Name, err)
 		}
 	}()
 
-waitRunning:
-	pod, err = s.kubernetesClient.CoreV1().Pods(s.namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+	sub := t.jobs.subscribe(job.Name)
+	defer t.jobs.unsubscribe(sub)
+
+	followed := map[string]bool{}
+	var lastFailure error
+
+	for {
+		pod, err := s.nextJobPod(ctx, t, op, sub, followed, w)
+		if err != nil {
+			failed = true
+			if errors.Is(err, errJobFailed) && lastFailure != nil {
+				return lastFailure
+			}
+			return err
+		}
+
+		followed[pod.Name] = true
+
+		err = s.streamLogs(ctx, t, pod, w)
+		if err != nil && pod.Status.Phase != corev1.PodFailed {
+			return err
+		}
+		// pods evicted or failed before their container started have no logs
+
+		pod, err = s.waitPodFinished(ctx, t, sub, pod.Name)
+		if err != nil {
+			return err
+		}
+
+		if pod.Status.Phase == corev1.PodSucceeded {
+			return nil
+		}
+
+		lastFailure = exitError{
+			code:    podExitCode(pod),
+			message: podFailure(op.kind, pod),
+		}
+		streamf(w, "%s\n", lastFailure)
+
+		// the job controller replaces failed pods until the backoff limit is reached
+	}
+}
+
+// createJob creates the job, with pods in their own user namespace unless hostUsers is set.
+func createJob(ctx context.Context, t *target, job *batchv1.Job, hostUsers bool) (*batchv1.Job, error) {
+	if hostUsers {
+		return t.Client.BatchV1().Jobs(t.Namespace).Create(ctx, job, metav1.CreateOptions{})
+	}
 
+	body, err := withoutHostUsers(job)
 	if err != nil {
-		return fmt.Errorf("look up pod %s: %v", pod.Name, err)
-	}
-
-	switch pod.Status.Phase {
-	case "Failed":
-		failed = true
-		fallthrough
-	case "Succeeded":
-		fallthrough
-	case "Running":
-		goto printLogs
-	default:
-		time.Sleep(time.Second)
-		goto waitRunning
-	}
-
-printLogs:
-	podLogs, err := s.kubernetesClient.CoreV1().Pods(s.namespace).
-		GetLogs(pod.Name, &corev1.PodLogOptions{Follow: true}).
-		Stream(ctx)
+		return nil, fmt.Errorf("encode job: %v", err)
+	}
+
+	created := &batchv1.Job{}
+
+	err = t.Client.BatchV1().RESTClient().Post().
+		Namespace(t.Namespace).
+		Resource("jobs").
+		SetHeader("Content-Type", "application/json").
+		Body(body).
+		Do(ctx).
+		Into(created)
 	if err != nil {
-		return fmt.Errorf("streaming pod %s logs: %v", pod.Name, err)
+		return nil, err
 	}
-	defer podLogs.Close()
 
-	buf := make([]byte, 1024)
+	return created, nil
+}
+
+// ownSecret makes the job the owner of the secret, kubernetes deletes the secret with the job.
+func (s Service) ownSecret(ctx context.Context, t *target, job *batchv1.Job, secretName string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"ownerReferences": []metav1.OwnerReference{
+				{
+					APIVersion: batchv1.SchemeGroupVersion.String(),
+					Kind:       "Job",
+					Name:       job.Name,
+					UID:        job.UID,
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = t.Client.CoreV1().Secrets(t.Namespace).Patch(ctx, secretName, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// nextJobPod waits for a pod of the job to start which has not been followed yet.
+// Pods not running within the maximum pending time or failing to pull an image fail the job with an explanation.
+func (s Service) nextJobPod(ctx context.Context, t *target, op operation, sub *jobSubscription, followed map[string]bool, w io.Writer) (*corev1.Pod, error) {
+	seen := false
+
+	maxPendingTime := s.config().MaxPendingTime.Duration
+	pendingTimeout := time.NewTimer(maxPendingTime)
+	defer pendingTimeout.Stop()
 
 	for {
-		n, err := podLogs.Read(buf)
-		if err != nil {
-			if err == io.EOF {
-				if failed {
-					return fmt.Errorf("pod %s failed", pod.Name)
+		job, err := t.jobs.job(sub.name)
+		switch {
+		case apierrors.IsNotFound(err) && seen:
+			return nil, fmt.Errorf("job %s was deleted", sub.name)
+		case err == nil:
+			seen = true
+
+			for _, condition := range job.Status.Conditions {
+				if condition.Type != batchv1.JobFailed || condition.Status != corev1.ConditionTrue {
+					continue
 				}
 
-				for {
-					pod, err = s.kubernetesClient.CoreV1().Pods(s.namespace).Get(ctx, pod.Name, metav1.GetOptions{})
-					if err != nil {
-						return fmt.Errorf("look up pod %s: %v", pod.Name, err)
-					}
-
-					switch pod.Status.Phase {
-					case "Succeeded":
-						return nil
-					case "Failed":
-						return fmt.Errorf("pod %s failed", pod.Name)
-					default:
-						log.Printf("pod %s phase %s", pod.Name, pod.Status.Phase)
-						time.Sleep(time.Second)
-					}
+				if condition.Reason == "DeadlineExceeded" {
+					return nil, fmt.Errorf("%s exceeded the maximum execution time of %v", op.kind, time.Duration(*job.Spec.ActiveDeadlineSeconds)*time.Second)
 				}
+
+				return nil, fmt.Errorf("%w: job %s: %s: %s", errJobFailed, sub.name, condition.Reason, condition.Message)
 			}
+		}
 
-			return fmt.Errorf("read pod %s logs: %v", pod.Name, err)
+		pods, err := t.jobs.jobPods(sub.name)
+		if err != nil {
+			return nil, err
 		}
 
-		w.Write([]byte(string(buf[:n])))
+		var pending *corev1.Pod
+
+		for _, pod := range pods {
+			if followed[pod.Name] {
+				continue
+			}
+
+			switch pod.Status.Phase {
+			case corev1.PodRunning, corev1.PodSucceeded, corev1.PodFailed:
+				return pod, nil
+			case corev1.PodPending:
+				pending = pod
+
+				// an image which can not be pulled will not appear by waiting longer
+				if message := podStartFailure(pod); message != "" {
+					return nil, fmt.Errorf("%s pod can not start: %s", op.kind, message)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-pendingTimeout.C:
+			if pending == nil {
+				return nil, fmt.Errorf("%s pod was not created within %v", op.kind, maxPendingTime)
+			}
+			return nil, fmt.Errorf("%s pod did not start within %v: %s", op.kind, maxPendingTime, podPending(pending))
+		case event := <-sub.events:
+			w.Write([]byte(formatEvent(event)))
+		case <-sub.changed:
+		}
 	}
 }
 
-func (s Service) podStatus(ctx context.Context, podName string) (corev1.PodPhase, error) {
-	pod, err := s.kubernetesClient.CoreV1().Pods(s.namespace).Get(ctx, podName, metav1.GetOptions{})
-	if err != nil {
-		return "", err
-	}
+func (s Service) waitPodFinished(ctx context.Context, t *target, sub *jobSubscription, name string) (*corev1.Pod, error) {
+	for {
+		pod, err := t.jobs.pod(name)
+		if apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("pod %s was deleted", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch pod.Status.Phase {
+		case corev1.PodSucceeded, corev1.PodFailed:
+			return pod, nil
+		}
 
-	return pod.Status.Phase, nil
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-sub.changed:
+		}
+	}
 }
 
-func streamf(w io.Writer, message string, args ...interface{}) []byte {
-	b, err := json.Marshal(fmt.Sprintf(message, args...))
+// streamf writes a message to the log stream of the client.
+func streamf(w io.Writer, message string, args ...interface{}) {
+	_, err := fmt.Fprintf(w, message, args...)
 	if err != nil {
-		panic(err) // encode a string to json should not fail
+		log.Printf("stream message: %v", err)
 	}
-
-	return []byte(fmt.Sprintf(`{"stream": %s}`, b))
 }
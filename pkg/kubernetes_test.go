@@ -0,0 +1,63 @@
+package wedding
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_ownSecret(t *testing.T) {
+	ctx := context.Background()
+	op, err := newOperation(buildOperation, httptest.NewRequest(http.MethodPost, "/build", nil))
+	if err != nil {
+		t.Fatalf("newOperation() error = %v", err)
+	}
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "wedding-build-a",
+			Namespace: "default",
+			UID:       "0b5a4b5e-2b36-4c2b-9f4e-1a2b3c4d5e6f",
+		},
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      op.secretName(),
+			Namespace: "default",
+			Labels:    op.label(nil),
+		},
+	}
+
+	client := fake.NewSimpleClientset(job, secret)
+	s := Service{}
+	target := &target{Target: Target{Name: "default", Namespace: "default", Client: client}}
+
+	err = s.ownSecret(ctx, target, job, secret.Name)
+	if err != nil {
+		t.Fatalf("ownSecret() error = %v", err)
+	}
+
+	got, err := client.CoreV1().Secrets("default").Get(ctx, secret.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get secret: %v", err)
+	}
+
+	if len(got.OwnerReferences) != 1 {
+		t.Fatalf("ownerReferences = %v, want one reference", got.OwnerReferences)
+	}
+
+	owner := got.OwnerReferences[0]
+	if owner.APIVersion != "batch/v1" || owner.Kind != "Job" || owner.Name != job.Name || owner.UID != job.UID {
+		t.Errorf("ownerReference = %+v, want job %s", owner, job.Name)
+	}
+
+	if got.Labels[operationIDLabel] != op.id || got.Labels[operationTypeLabel] != buildOperation {
+		t.Errorf("labels = %v, want operation %s", got.Labels, op.id)
+	}
+}
@@ -0,0 +1,240 @@
+package wedding
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const localContextRoute = "/_wedding/contexts/"
+
+// LocalContexts keeps build contexts on the disk of wedding and serves them to
+// the build pods itself, no object store is needed.
+// Each context is served with a secret url, every pod of the job may download it once.
+type LocalContexts struct {
+	dir       string
+	url       string
+	downloads int
+
+	mu     sync.Mutex
+	grants map[string]*contextGrant
+}
+
+// contextGrant allows to download a context with its token until it expires.
+type contextGrant struct {
+	path    string
+	expires time.Time
+	lists   int
+	files   int
+}
+
+// NewLocalContexts stores contexts in dir. Build pods reach wedding at url,
+// downloads is the number of pods a job may start.
+func NewLocalContexts(dir, url string, downloads int) (*LocalContexts, error) {
+	err := os.MkdirAll(filepath.Join(dir, contextPrefix), 0700)
+	if err != nil {
+		return nil, fmt.Errorf("create context directory: %v", err)
+	}
+
+	return &LocalContexts{
+		dir:       dir,
+		url:       strings.TrimSuffix(url, "/"),
+		downloads: downloads,
+		grants:    map[string]*contextGrant{},
+	}, nil
+}
+
+// storeContext writes the build context to disk.
+func (l *LocalContexts) storeContext(ctx context.Context, r io.Reader, cfg *buildConfig, inflight *inflight, chunkTTL time.Duration) error {
+	cfg.contextFilePath = fmt.Sprintf("%s%d", contextPrefix, time.Now().UnixNano())
+
+	f, err := os.OpenFile(l.path(cfg.contextFilePath), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("create build context: %v", err)
+	}
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("write build context: %v", err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("write build context: %v", err)
+	}
+
+	return nil
+}
+
+// presignContext grants the pods of the build to download the context until expiry
+// and returns the url of its chunk list.
+func (l *LocalContexts) presignContext(ctx context.Context, cfg *buildConfig, expiry time.Duration) (string, error) {
+	b := make([]byte, 32)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("generate context token: %v", err)
+	}
+
+	token := hex.EncodeToString(b)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.grants[token] = &contextGrant{
+		path:    cfg.contextFilePath,
+		expires: time.Now().Add(expiry),
+		lists:   l.downloads,
+		files:   l.downloads,
+	}
+
+	return l.url + localContextRoute + token, nil
+}
+
+// deleteContext deletes the context and revokes the grants to download it.
+func (l *LocalContexts) deleteContext(ctx context.Context, cfg *buildConfig) error {
+	l.mu.Lock()
+	for token, grant := range l.grants {
+		if grant.path == cfg.contextFilePath {
+			delete(l.grants, token)
+		}
+	}
+	l.mu.Unlock()
+
+	err := os.Remove(l.path(cfg.contextFilePath))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// collectGarbage deletes build contexts older than maxAge and expired grants.
+// Contexts are not chunked, chunkTTL is ignored.
+func (l *LocalContexts) collectGarbage(ctx context.Context, inflight *inflight, maxAge, chunkTTL time.Duration) (int, int, error) {
+	now := time.Now()
+
+	l.mu.Lock()
+	for token, grant := range l.grants {
+		if now.After(grant.expires) {
+			delete(l.grants, token)
+		}
+	}
+	l.mu.Unlock()
+
+	files, err := ioutil.ReadDir(filepath.Join(l.dir, contextPrefix))
+	if err != nil {
+		return 0, 0, fmt.Errorf("list contexts: %v", err)
+	}
+
+	contexts := 0
+
+	for _, file := range files {
+		key := contextPrefix + file.Name()
+
+		if inflight.contains(key) || !file.ModTime().Before(now.Add(-maxAge)) {
+			continue
+		}
+
+		err = os.Remove(l.path(key))
+		if err != nil {
+			log.Printf("garbage collection: delete context %s: %v", key, err)
+			continue
+		}
+
+		log.Printf("garbage collection: deleted context %s", key)
+		contexts++
+	}
+
+	return contexts, 0, nil
+}
+
+func (l *LocalContexts) path(key string) string {
+	return filepath.Join(l.dir, filepath.FromSlash(key))
+}
+
+// grant uses up one download of the list or the file of the context.
+func (l *LocalContexts) grant(token string, list bool) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	grant, ok := l.grants[token]
+	if !ok {
+		return "", false
+	}
+
+	if time.Now().After(grant.expires) {
+		delete(l.grants, token)
+		return "", false
+	}
+
+	remaining := &grant.files
+	if list {
+		remaining = &grant.lists
+	}
+
+	if *remaining <= 0 {
+		return "", false
+	}
+	*remaining--
+
+	return grant.path, true
+}
+
+// serveList serves the chunk list of the context, a single url of the whole context.
+func (l *LocalContexts) serveList(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+
+	_, ok := l.grant(token, true)
+	if !ok {
+		contextNotFound(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, l.url+localContextRoute+token+"/context")
+}
+
+// serveContext serves the build context as tar archive.
+func (l *LocalContexts) serveContext(w http.ResponseWriter, r *http.Request) {
+	path, ok := l.grant(mux.Vars(r)["token"], false)
+	if !ok {
+		contextNotFound(w)
+		return
+	}
+
+	f, err := os.Open(l.path(path))
+	if err != nil {
+		log.Printf("serve context %s: %v", path, err)
+		contextNotFound(w)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/x-tar")
+
+	_, err = io.Copy(w, f)
+	if err != nil {
+		log.Printf("serve context %s: %v", path, err)
+	}
+}
+
+func contextNotFound(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotFound)
+	w.Write([]byte("context not found"))
+}
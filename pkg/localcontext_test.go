@@ -0,0 +1,86 @@
+package wedding
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_LocalContexts(t *testing.T) {
+	contexts, err := NewLocalContexts(t.TempDir(), "http://wedding:2375/", 2)
+	if err != nil {
+		t.Fatalf("NewLocalContexts() error = %v", err)
+	}
+
+	s := &Service{contexts: contexts}
+	s.routes("", "")
+
+	get := func(url string) (int, string) {
+		url = strings.TrimPrefix(url, "http://wedding:2375")
+
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+
+		return w.Code, w.Body.String()
+	}
+
+	ctx := context.Background()
+	cfg := &buildConfig{}
+
+	err = contexts.storeContext(ctx, strings.NewReader("Dockerfile"), cfg, newInflight(), time.Hour)
+	if err != nil {
+		t.Fatalf("storeContext() error = %v", err)
+	}
+
+	url, err := contexts.presignContext(ctx, cfg, time.Minute)
+	if err != nil {
+		t.Fatalf("presignContext() error = %v", err)
+	}
+
+	// the job may start two pods
+	for i := 0; i < 2; i++ {
+		code, list := get(url)
+		if code != http.StatusOK || list != url+"/context\n" {
+			t.Fatalf("GET chunk list = %d %q, want the url of the context", code, list)
+		}
+
+		code, body := get(strings.TrimSpace(list))
+		if code != http.StatusOK || body != "Dockerfile" {
+			t.Fatalf("GET context = %d %q, want the context", code, body)
+		}
+	}
+
+	code, _ := get(url + "/context")
+	if code != http.StatusNotFound {
+		t.Errorf("GET context a third time = %d, want %d", code, http.StatusNotFound)
+	}
+
+	code, _ = get("/_wedding/contexts/guessed/context")
+	if code != http.StatusNotFound {
+		t.Errorf("GET context with unknown token = %d, want %d", code, http.StatusNotFound)
+	}
+
+	expired, err := contexts.presignContext(ctx, cfg, -time.Minute)
+	if err != nil {
+		t.Fatalf("presignContext() error = %v", err)
+	}
+
+	code, _ = get(expired)
+	if code != http.StatusNotFound {
+		t.Errorf("GET expired chunk list = %d, want %d", code, http.StatusNotFound)
+	}
+
+	err = contexts.deleteContext(ctx, cfg)
+	if err != nil {
+		t.Fatalf("deleteContext() error = %v", err)
+	}
+
+	_, err = os.Stat(contexts.path(cfg.contextFilePath))
+	if !os.IsNotExist(err) {
+		t.Errorf("context still exists after deleteContext(): %v", err)
+	}
+}
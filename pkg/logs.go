@@ -0,0 +1,188 @@
+package wedding
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	logReconnectAttempts = 5
+	logReconnectDelay    = 2 * time.Second
+)
+
+// streamLogs follows the log of the pod until its container finished.
+// Interrupted streams are resumed, the client receives every line once.
+func (s Service) streamLogs(ctx context.Context, t *target, pod *corev1.Pod, w io.Writer) error {
+	cursor := &logCursor{}
+	failures := 0
+
+	for {
+		progressed, err := followLogs(ctx, t, pod.Name, cursor, w)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var status apierrors.APIStatus
+		if err != nil && !progressed && errors.As(err, &status) && !isUnreachable(err) && !apierrors.IsInternalError(err) {
+			// pods which failed before their container started have no logs,
+			// interrupted streams are resumed
+			return fmt.Errorf("streaming pod %s logs: %v", pod.Name, err)
+		}
+
+		if err == nil && containerFinished(t, pod.Name) {
+			return nil
+		}
+
+		if progressed {
+			failures = 0
+		}
+		failures++
+
+		if failures > logReconnectAttempts {
+			if err == nil {
+				// the stream ended repeatedly, the watched pod state is behind
+				return nil
+			}
+			return fmt.Errorf("read pod %s logs: %v", pod.Name, err)
+		}
+
+		if err != nil {
+			log.Printf("read pod %s logs: %v, reconnecting", pod.Name, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(logReconnectDelay):
+		}
+
+		cursor.reconnect()
+	}
+}
+
+// followLogs forwards the log lines not forwarded before until the stream ends.
+func followLogs(ctx context.Context, t *target, name string, cursor *logCursor, w io.Writer) (bool, error) {
+	podLogs, err := t.Client.CoreV1().Pods(t.Namespace).
+		GetLogs(name, cursor.options()).
+		Stream(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer podLogs.Close()
+
+	progressed := false
+	reader := bufio.NewReader(podLogs)
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return progressed, nil
+		}
+		if err != nil && err != io.EOF {
+			// an incomplete line is read again after reconnecting
+			return progressed, err
+		}
+
+		message, ok := cursor.forward(line)
+		if ok {
+			progressed = true
+			w.Write([]byte(message))
+		}
+
+		if err == io.EOF {
+			return progressed, nil
+		}
+	}
+}
+
+// containerFinished checks the watched state of the pod.
+func containerFinished(t *target, name string) bool {
+	pod, err := t.jobs.pod(name)
+	if err != nil {
+		return true
+	}
+
+	switch pod.Status.Phase {
+	case corev1.PodSucceeded, corev1.PodFailed:
+		return true
+	}
+
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Terminated == nil {
+			return false
+		}
+	}
+
+	return len(pod.Status.ContainerStatuses) != 0
+}
+
+// logCursor remembers the position in a pod log to resume it after a reconnect.
+// Kubernetes resumes logs at a full second, lines forwarded already are skipped by
+// their timestamp and, for lines with the same timestamp, by their count.
+type logCursor struct {
+	last     time.Time
+	seen     int
+	replayed int
+}
+
+func (c *logCursor) options() *corev1.PodLogOptions {
+	options := &corev1.PodLogOptions{
+		Follow:     true,
+		Timestamps: true,
+	}
+
+	if !c.last.IsZero() {
+		since := metav1.NewTime(c.last)
+		options.SinceTime = &since
+	}
+
+	return options
+}
+
+func (c *logCursor) reconnect() {
+	c.replayed = 0
+}
+
+// forward strips the timestamp from the log line and reports whether it is new.
+func (c *logCursor) forward(line string) (string, bool) {
+	idx := strings.IndexByte(line, ' ')
+	if idx == -1 {
+		return line, true
+	}
+
+	timestamp, err := time.Parse(time.RFC3339Nano, line[:idx])
+	if err != nil {
+		return line, true
+	}
+
+	message := line[idx+1:]
+
+	switch {
+	case timestamp.Before(c.last):
+		return "", false
+
+	case timestamp.Equal(c.last):
+		c.replayed++
+		if c.replayed <= c.seen {
+			return "", false
+		}
+		c.seen++
+
+	default:
+		c.last = timestamp
+		c.seen = 1
+		c.replayed = 1
+	}
+
+	return message, true
+}
@@ -0,0 +1,61 @@
+package wedding
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_logCursor(t *testing.T) {
+	c := &logCursor{}
+
+	connections := [][]string{
+		{
+			"2021-06-01T10:00:00.100000000Z #1 [internal] load build definition from Dockerfile\n",
+			"2021-06-01T10:00:01.200000000Z #2 [1/2] FROM alpine\n",
+			"2021-06-01T10:00:01.200000000Z #2 DONE 0.0s\n",
+		},
+		// resumed at the full second
+		{
+			"2021-06-01T10:00:01.200000000Z #2 [1/2] FROM alpine\n",
+			"2021-06-01T10:00:01.200000000Z #2 DONE 0.0s\n",
+			"2021-06-01T10:00:01.200000000Z \n",
+			"2021-06-01T10:00:01.700000000Z #3 [2/2] RUN make test\n",
+		},
+		{
+			"2021-06-01T10:00:01.200000000Z #2 [1/2] FROM alpine\n",
+			"2021-06-01T10:00:01.200000000Z #2 DONE 0.0s\n",
+			"2021-06-01T10:00:01.200000000Z \n",
+			"2021-06-01T10:00:01.700000000Z #3 [2/2] RUN make test\n",
+			"2021-06-01T10:00:02.000000000Z #3 DONE 0.3s\n",
+		},
+	}
+
+	got := &strings.Builder{}
+	for idx, lines := range connections {
+		if idx != 0 {
+			c.reconnect()
+
+			options := c.options()
+			if options.SinceTime == nil || !options.Timestamps {
+				t.Fatalf("options() = %+v, want to resume with timestamps", options)
+			}
+		}
+
+		for _, line := range lines {
+			if message, ok := c.forward(line); ok {
+				got.WriteString(message)
+			}
+		}
+	}
+
+	want := `#1 [internal] load build definition from Dockerfile
+#2 [1/2] FROM alpine
+#2 DONE 0.0s
+
+#3 [2/2] RUN make test
+#3 DONE 0.3s
+`
+	if got.String() != want {
+		t.Errorf("forwarded %q, want %q", got.String(), want)
+	}
+}
@@ -40,12 +40,17 @@ func (o output) Errorf(e string, args ...interface{}) error {
 }
 
 func (o output) Error(e string) error {
+	return o.ErrorCode(1, e)
+}
+
+// ErrorCode reports an error with the exit code of the failed command.
+func (o output) ErrorCode(code int, e string) error {
 	b, err := json.Marshal(string(e))
 	if err != nil {
 		return err
 	}
 
-	msg := fmt.Sprintf(`{"error": %s, "errorDetail": {"code": %d, "message": %s}}`, b, 1, b)
+	msg := fmt.Sprintf(`{"error": %s, "errorDetail": {"code": %d, "message": %s}}`, b, code, b)
 
 	_, err = o.w.Write([]byte(msg))
 	if err != nil {
@@ -75,7 +80,7 @@ func versionHandler(gitHash, gitRef string) http.HandlerFunc {
 			"Details": {
 				"Scheduler": "kubernetes",
 				"Builds": "buildkit",
-				"Pull/Tag/Push": "skopeo",
+				"Pull/Tag/Push": "registry api",
 				"GitCommit": "%s",
 				"GitBranch": "%s"
 			}
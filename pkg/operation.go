@@ -0,0 +1,94 @@
+package wedding
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	buildOperation = "build"
+
+	timeoutHeader = "X-Wedding-Timeout"
+
+	operationIDLabel   = "operation-id"
+	operationTypeLabel = "operation-type"
+)
+
+// operation identifies a single build, pull or push request and links
+// the job, pods, secret and build context created for it.
+// Tenant and priority decide its place in the queue,
+// tenant, platform and target selector the target it runs on.
+// A zero timeout uses the default execution time.
+type operation struct {
+	id             string
+	kind           string
+	tenant         string
+	priority       int
+	platform       string
+	targetSelector string
+	timeout        time.Duration
+}
+
+func newOperation(kind string, r *http.Request) (operation, error) {
+	b := make([]byte, 8)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+
+	timeout, err := requestTimeout(r)
+	if err != nil {
+		return operation{}, err
+	}
+
+	return operation{
+		id:             hex.EncodeToString(b),
+		kind:           kind,
+		tenant:         requestTenant(r),
+		priority:       requestPriority(r),
+		platform:       r.URL.Query().Get("platform"),
+		targetSelector: r.Header.Get(targetSelectorHeader),
+		timeout:        timeout,
+	}, nil
+}
+
+// requestTimeout reads the execution time requested by the client, like 1h30m.
+// Jobs are limited in seconds, shorter timeouts are rejected.
+func requestTimeout(r *http.Request) (time.Duration, error) {
+	value := r.Header.Get(timeoutHeader)
+	if value == "" {
+		return 0, nil
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("parse %s: %v", timeoutHeader, err)
+	}
+
+	if timeout < time.Second {
+		return 0, fmt.Errorf("%s %s is shorter than 1s", timeoutHeader, value)
+	}
+
+	return timeout, nil
+}
+
+// label adds the operation labels to the given labels.
+func (op operation) label(labels map[string]string) map[string]string {
+	if labels == nil {
+		labels = map[string]string{}
+	}
+
+	labels[operationIDLabel] = op.id
+	labels[operationTypeLabel] = op.kind
+
+	return labels
+}
+
+// secretName is the name of the secret holding the docker config of the operation.
+func (op operation) secretName() string {
+	return dockerConfigSecretPrefix + op.id
+}
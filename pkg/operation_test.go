@@ -0,0 +1,40 @@
+package wedding
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_requestTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    time.Duration
+		wantErr bool
+	}{
+		{name: "default", header: "", want: 0},
+		{name: "minutes", header: "45m", want: 45 * time.Minute},
+		{name: "one second", header: "1s", want: time.Second},
+		{name: "sub-second", header: "500ms", wantErr: true},
+		{name: "negative", header: "-5m", wantErr: true},
+		{name: "invalid", header: "soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/build", nil)
+			if tt.header != "" {
+				r.Header.Set(timeoutHeader, tt.header)
+			}
+
+			got, err := requestTimeout(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("requestTimeout() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("requestTimeout() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
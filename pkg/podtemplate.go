@@ -0,0 +1,110 @@
+package wedding
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"sigs.k8s.io/yaml"
+)
+
+const podTemplatePrefix = "podtemplate/"
+
+// PodTemplates are the admin supplied templates merged into the pods of a job type.
+// Keys are the job types buildkit and skopeo.
+type PodTemplates map[string]PodTemplateSource
+
+// PodTemplateSource is a PodTemplate read from a file or a PodTemplate object in the namespace.
+type PodTemplateSource struct {
+	name     string
+	template *corev1.PodTemplate
+}
+
+// NewPodTemplateSource loads a PodTemplate from a YAML or JSON file,
+// or refers to a PodTemplate object when source has the form podtemplate/NAME.
+// Objects are read for every job, so changes apply without a restart.
+func NewPodTemplateSource(source string) (PodTemplateSource, error) {
+	if strings.HasPrefix(source, podTemplatePrefix) {
+		name := strings.TrimPrefix(source, podTemplatePrefix)
+		if name == "" {
+			return PodTemplateSource{}, fmt.Errorf("pod template name missing in %s", source)
+		}
+
+		return PodTemplateSource{name: name}, nil
+	}
+
+	b, err := ioutil.ReadFile(source)
+	if err != nil {
+		return PodTemplateSource{}, fmt.Errorf("read pod template: %v", err)
+	}
+
+	template := &corev1.PodTemplate{}
+
+	err = yaml.UnmarshalStrict(b, template)
+	if err != nil {
+		return PodTemplateSource{}, fmt.Errorf("decode pod template %s: %v", source, err)
+	}
+
+	if template.Kind != "PodTemplate" {
+		return PodTemplateSource{}, fmt.Errorf("%s contains kind %q, expected PodTemplate", source, template.Kind)
+	}
+
+	return PodTemplateSource{template: template}, nil
+}
+
+// applyPodTemplate merges the generated pod into the pod template of its job type.
+// Fields set by wedding take precedence, containers are merged by name.
+func (s Service) applyPodTemplate(ctx context.Context, t *target, pod *corev1.Pod) (*corev1.Pod, error) {
+	source, ok := s.podTemplates[pod.Labels["job"]]
+	if !ok {
+		return pod, nil
+	}
+
+	template := source.template
+	if source.name != "" {
+		var err error
+		template, err = t.Client.CoreV1().PodTemplates(t.Namespace).Get(ctx, source.name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("get pod template %s: %v", source.name, err)
+		}
+	}
+
+	return mergePodTemplate(template, pod)
+}
+
+func mergePodTemplate(template *corev1.PodTemplate, pod *corev1.Pod) (*corev1.Pod, error) {
+	original, err := json.Marshal(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:      template.Template.Labels,
+			Annotations: template.Template.Annotations,
+		},
+		Spec: template.Template.Spec,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	patch, err := json.Marshal(pod)
+	if err != nil {
+		return nil, err
+	}
+
+	merged, err := strategicpatch.StrategicMergePatch(original, patch, corev1.Pod{})
+	if err != nil {
+		return nil, fmt.Errorf("merge pod template: %v", err)
+	}
+
+	result := &corev1.Pod{}
+
+	err = json.Unmarshal(merged, result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
@@ -0,0 +1,165 @@
+package wedding
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_NewPodTemplateSource(t *testing.T) {
+	dir := t.TempDir()
+
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		err := ioutil.WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name     string
+		source   string
+		wantName string
+		wantNode string
+		wantErr  bool
+	}{
+		{
+			name:     "object",
+			source:   "podtemplate/builds",
+			wantName: "builds",
+		},
+		{
+			name:    "object without name",
+			source:  "podtemplate/",
+			wantErr: true,
+		},
+		{
+			name: "yaml file",
+			source: write("template.yaml", `
+apiVersion: v1
+kind: PodTemplate
+metadata:
+  name: builds
+template:
+  spec:
+    nodeSelector:
+      pool: builds
+`),
+			wantNode: "builds",
+		},
+		{
+			name:    "wrong kind",
+			source:  write("pod.yaml", "apiVersion: v1\nkind: Pod\n"),
+			wantErr: true,
+		},
+		{
+			name:    "missing file",
+			source:  filepath.Join(dir, "missing.yaml"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewPodTemplateSource(tt.source)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewPodTemplateSource() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.name != tt.wantName {
+				t.Errorf("NewPodTemplateSource() name = %v, want %v", got.name, tt.wantName)
+			}
+			if tt.wantNode != "" && got.template.Template.Spec.NodeSelector["pool"] != tt.wantNode {
+				t.Errorf("NewPodTemplateSource() nodeSelector = %v, want pool %v", got.template.Template.Spec.NodeSelector, tt.wantNode)
+			}
+		})
+	}
+}
+
+func Test_mergePodTemplate(t *testing.T) {
+	template := &corev1.PodTemplate{
+		Template: corev1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels:      map[string]string{"team": "platform", "app": "other"},
+				Annotations: map[string]string{"cluster-autoscaler.kubernetes.io/safe-to-evict": "false"},
+			},
+			Spec: corev1.PodSpec{
+				NodeSelector:       map[string]string{"pool": "builds"},
+				Tolerations:        []corev1.Toleration{{Key: "builds", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoSchedule}},
+				PriorityClassName:  "builds",
+				ServiceAccountName: "builder",
+				ImagePullSecrets:   []corev1.LocalObjectReference{{Name: "mirror"}},
+				Containers: []corev1.Container{
+					{
+						Name:    "buildkit",
+						Image:   "ignored",
+						Command: []string{"ignored"},
+						Env:     []corev1.EnvVar{{Name: "HTTP_PROXY", Value: "http://proxy:3128"}},
+					},
+				},
+			},
+		},
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "wedding-build-",
+			Labels:       map[string]string{"app": "wedding", "job": "buildkit"},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:    "buildkit",
+					Image:   DefaultConfig().BuildkitImage,
+					Command: []string{"timeout", "1800"},
+					Env:     []corev1.EnvVar{{Name: "CONTEXT_URL", Value: "http://context"}},
+				},
+			},
+			RestartPolicy: corev1.RestartPolicyNever,
+		},
+	}
+
+	got, err := mergePodTemplate(template, pod)
+	if err != nil {
+		t.Fatalf("mergePodTemplate() error = %v", err)
+	}
+
+	wantLabels := map[string]string{"app": "wedding", "job": "buildkit", "team": "platform"}
+	if !reflect.DeepEqual(got.Labels, wantLabels) {
+		t.Errorf("labels = %v, want %v", got.Labels, wantLabels)
+	}
+	if got.GenerateName != "wedding-build-" {
+		t.Errorf("generateName = %v, want wedding-build-", got.GenerateName)
+	}
+	if got.Annotations["cluster-autoscaler.kubernetes.io/safe-to-evict"] != "false" {
+		t.Errorf("annotations = %v, want template annotation", got.Annotations)
+	}
+	if got.Spec.NodeSelector["pool"] != "builds" || len(got.Spec.Tolerations) != 1 {
+		t.Errorf("scheduling = %v %v, want template node pool", got.Spec.NodeSelector, got.Spec.Tolerations)
+	}
+	if got.Spec.PriorityClassName != "builds" || got.Spec.ServiceAccountName != "builder" || len(got.Spec.ImagePullSecrets) != 1 {
+		t.Errorf("spec = %+v, want template priority class, service account and pull secrets", got.Spec)
+	}
+	if got.Spec.RestartPolicy != corev1.RestartPolicyNever {
+		t.Errorf("restartPolicy = %v, want %v", got.Spec.RestartPolicy, corev1.RestartPolicyNever)
+	}
+
+	if len(got.Spec.Containers) != 1 {
+		t.Fatalf("containers = %v, want one merged container", got.Spec.Containers)
+	}
+	container := got.Spec.Containers[0]
+	if container.Image != DefaultConfig().BuildkitImage || !reflect.DeepEqual(container.Command, []string{"timeout", "1800"}) {
+		t.Errorf("container = %v %v, want generated image and command", container.Image, container.Command)
+	}
+	if len(container.Env) != 2 {
+		t.Errorf("env = %v, want template and generated variables", container.Env)
+	}
+}
@@ -0,0 +1,255 @@
+package wedding
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	pullAction = "pull"
+	pushAction = "push"
+
+	digestMarker = "wedding-digest "
+	sizeMarker   = "wedding-size "
+)
+
+// jsonMessage is the subset of the docker jsonmessage format wedding emits.
+type jsonMessage struct {
+	Status         string          `json:"status,omitempty"`
+	ProgressDetail *progressDetail `json:"progressDetail,omitempty"`
+	ID             string          `json:"id,omitempty"`
+	Aux            interface{}     `json:"aux,omitempty"`
+}
+
+type progressDetail struct {
+	Current int64 `json:"current,omitempty"`
+	Total   int64 `json:"total,omitempty"`
+}
+
+type pushResult struct {
+	Tag    string
+	Digest string
+	Size   int
+}
+
+func (o output) message(m jsonMessage) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	_, err = o.w.Write(b)
+	if err != nil {
+		return err
+	}
+
+	if f, ok := o.w.(http.Flusher); ok {
+		f.Flush()
+	} else {
+		return fmt.Errorf("stream can not be flushed")
+	}
+
+	return nil
+}
+
+// Status reports a status line, optionally bound to an id like a layer.
+func (o output) Status(id, status string) error {
+	return o.message(jsonMessage{
+		Status:         status,
+		ProgressDetail: &progressDetail{},
+		ID:             id,
+	})
+}
+
+// Progress reports the transfer progress of a layer.
+func (o output) Progress(id, status string, current, total int64) error {
+	return o.message(jsonMessage{
+		Status:         status,
+		ProgressDetail: &progressDetail{Current: current, Total: total},
+		ID:             id,
+	})
+}
+
+// Aux reports structured data like the result of a push.
+func (o output) Aux(aux interface{}) error {
+	return o.message(jsonMessage{
+		ProgressDetail: &progressDetail{},
+		Aux:            aux,
+	})
+}
+
+func shortID(digest string) string {
+	id := strings.TrimPrefix(digest, "sha256:")
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// skopeoProgress translates the plain text output of skopeo copy into
+// docker jsonmessages with one status line per blob.
+// skopeo does not report the bytes transferred without a terminal, the blobs
+// are reported without progress.
+type skopeoProgress struct {
+	o       *output
+	action  string
+	line    bytes.Buffer
+	pending []string
+	digest  string
+	size    int
+}
+
+func newSkopeoProgress(o *output, action string) *skopeoProgress {
+	return &skopeoProgress{
+		o:      o,
+		action: action,
+	}
+}
+
+func (p *skopeoProgress) Write(b []byte) (int, error) {
+	for _, c := range b {
+		if c != '\n' {
+			p.line.WriteByte(c)
+			continue
+		}
+
+		err := p.handleLine(p.line.String())
+		if err != nil {
+			return 0, err
+		}
+		p.line.Reset()
+	}
+
+	return len(b), nil
+}
+
+// Flush handles a last line not terminated by a newline.
+func (p *skopeoProgress) Flush() error {
+	if p.line.Len() == 0 {
+		return nil
+	}
+
+	line := p.line.String()
+	p.line.Reset()
+
+	return p.handleLine(line)
+}
+
+func (p *skopeoProgress) handleLine(line string) error {
+	switch {
+	case strings.HasPrefix(line, digestMarker):
+		p.digest = strings.TrimSpace(strings.TrimPrefix(line, digestMarker))
+		return nil
+
+	case strings.HasPrefix(line, sizeMarker):
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, sizeMarker)))
+		if err == nil {
+			p.size = size
+		}
+		return nil
+
+	case strings.HasPrefix(line, "Copying blob "):
+		fields := strings.Fields(strings.TrimPrefix(line, "Copying blob "))
+		if len(fields) == 0 {
+			return nil
+		}
+		digest := fields[0]
+
+		if strings.Contains(line, "skipped: already exists") {
+			if p.action == pushAction {
+				return p.o.Status(shortID(digest), "Layer already exists")
+			}
+			return p.o.Status(shortID(digest), "Already exists")
+		}
+
+		p.pending = append(p.pending, digest)
+
+		if p.action == pushAction {
+			return p.o.Status(shortID(digest), "Preparing")
+		}
+		return p.o.Status(shortID(digest), "Pulling fs layer")
+
+	case strings.HasPrefix(line, "Copying config "):
+		// skopeo copies the config after all layers are transferred
+		return p.completeLayers()
+
+	case line == "Getting image source signatures",
+		line == "Writing manifest to image destination",
+		line == "Storing signatures":
+		return nil
+	}
+
+	_, err := p.o.Write([]byte(line + "\n"))
+	return err
+}
+
+func (p *skopeoProgress) completeLayers() error {
+	for _, digest := range p.pending {
+		id := shortID(digest)
+
+		if p.action == pushAction {
+			err := p.o.Status(id, "Pushed")
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err := p.o.Status(id, "Download complete")
+		if err != nil {
+			return err
+		}
+		err = p.o.Status(id, "Pull complete")
+		if err != nil {
+			return err
+		}
+	}
+
+	p.pending = nil
+
+	return nil
+}
+
+// finishPull reports the digest of the pulled image.
+func (p *skopeoProgress) finishPull(image string) error {
+	err := p.completeLayers()
+	if err != nil {
+		return err
+	}
+
+	if p.digest != "" {
+		err = p.o.Status("", fmt.Sprintf("Digest: %s", p.digest))
+		if err != nil {
+			return err
+		}
+	}
+
+	return p.o.Status("", fmt.Sprintf("Status: Downloaded newer image for %s", image))
+}
+
+// finishPush reports the digest of the pushed image the way docker clients expect it.
+func (p *skopeoProgress) finishPush(tag string) error {
+	err := p.completeLayers()
+	if err != nil {
+		return err
+	}
+
+	if p.digest == "" {
+		return fmt.Errorf("digest of pushed image not found")
+	}
+
+	err = p.o.Status("", fmt.Sprintf("%s: digest: %s size: %d", tag, p.digest, p.size))
+	if err != nil {
+		return err
+	}
+
+	return p.o.Aux(pushResult{
+		Tag:    tag,
+		Digest: p.digest,
+		Size:   p.size,
+	})
+}
@@ -0,0 +1,78 @@
+package wedding
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_skopeoProgress(t *testing.T) {
+	tests := []struct {
+		name   string
+		action string
+		input  string
+		want   string
+	}{
+		{
+			name:   "push",
+			action: pushAction,
+			input: `Getting image source signatures
+Copying blob sha256:166a2418f7e86fa48d87bf6807b4e5b35f078acb2ad1cbf10444a7025913c24f
+Copying blob sha256:1966ea362d2394e7c5c508ebf3695f039dd3825bd1e7a07449ae530aea3c4cd1 skipped: already exists
+Copying config sha256:d7e07a2c74d972a2a645ea9ba4d4970a71b2795611236ff61810cb30b60d7725
+Writing manifest to image destination
+Storing signatures
+wedding-digest sha256:3acb5d16e32a8cf7094e195a5d24ca15d4fbe8a433a8bd5cc2365040739eb2dc
+wedding-size 528
+`,
+			want: `{"status":"Preparing","progressDetail":{},"id":"166a2418f7e8"}` +
+				`{"status":"Layer already exists","progressDetail":{},"id":"1966ea362d23"}` +
+				`{"status":"Pushed","progressDetail":{},"id":"166a2418f7e8"}` +
+				`{"status":"latest: digest: sha256:3acb5d16e32a8cf7094e195a5d24ca15d4fbe8a433a8bd5cc2365040739eb2dc size: 528","progressDetail":{}}` +
+				`{"progressDetail":{},"aux":{"Tag":"latest","Digest":"sha256:3acb5d16e32a8cf7094e195a5d24ca15d4fbe8a433a8bd5cc2365040739eb2dc","Size":528}}`,
+		},
+		{
+			name:   "pull",
+			action: pullAction,
+			input: `wedding-digest sha256:3acb5d16e32a8cf7094e195a5d24ca15d4fbe8a433a8bd5cc2365040739eb2dc
+Copying blob sha256:166a2418f7e86fa48d87bf6807b4e5b35f078acb2ad1cbf10444a7025913c24f
+Copying config sha256:d7e07a2c74d972a2a645ea9ba4d4970a71b2795611236ff61810cb30b60d7725
+time="2021-05-20T10:00:00Z" level=warning msg="unrelated"`,
+			want: `{"status":"Pulling fs layer","progressDetail":{},"id":"166a2418f7e8"}` +
+				`{"status":"Download complete","progressDetail":{},"id":"166a2418f7e8"}` +
+				`{"status":"Pull complete","progressDetail":{},"id":"166a2418f7e8"}` +
+				`{"stream": "time=\"2021-05-20T10:00:00Z\" level=warning msg=\"unrelated\"\n"}` +
+				`{"status":"Digest: sha256:3acb5d16e32a8cf7094e195a5d24ca15d4fbe8a433a8bd5cc2365040739eb2dc","progressDetail":{}}` +
+				`{"status":"Status: Downloaded newer image for alpine:latest","progressDetail":{}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			p := newSkopeoProgress(&output{w: w}, tt.action)
+
+			if _, err := p.Write([]byte(tt.input)); err != nil {
+				t.Errorf("skopeoProgress.Write() error = %v", err)
+				return
+			}
+			if err := p.Flush(); err != nil {
+				t.Errorf("skopeoProgress.Flush() error = %v", err)
+				return
+			}
+
+			var err error
+			if tt.action == pushAction {
+				err = p.finishPush("latest")
+			} else {
+				err = p.finishPull("alpine:latest")
+			}
+			if err != nil {
+				t.Errorf("skopeoProgress finish error = %v", err)
+				return
+			}
+
+			if got := w.Body.String(); got != tt.want {
+				t.Errorf("skopeoProgress output = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package wedding
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
@@ -41,14 +42,17 @@ func (s Service) pullImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if args.Get("platform") != "" {
-		w.WriteHeader(http.StatusNotImplemented)
-		w.Write([]byte("platform is not supported"))
+	platform := args.Get("platform")
+	if platform != "" && !platformPattern.MatchString(platform) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("unsupported platform '%s'", platform)))
 		return
 	}
+	if platform == "" {
+		platform = s.config().DefaultPlatform
+	}
 
 	from := fmt.Sprintf("%s:%s", fromImage, pullTag)
-	to := fmt.Sprintf("wedding-registry:5000/images/%s", escapePort(from))
 
 	dockerCfg, err := xRegistryAuth(r.Header.Get("X-Registry-Auth")).toDockerConfig()
 	if err != nil {
@@ -58,12 +62,115 @@ func (s Service) pullImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	script := fmt.Sprintf(`skopeo copy --retry-times 3 --dest-tls-verify=false docker://%s docker://%s`, from, to)
+	op, err := newOperation(pullAction, r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
 
 	o := &output{w: w}
-	err = s.runSkopeoPod(r.Context(), o, "pull", script, dockerCfg.mustToJSON())
+
+	err = o.Status(pullTag, fmt.Sprintf("Pulling from %s", fromImage))
+	if err != nil {
+		log.Printf("execute pull: %v", err)
+		return
+	}
+
+	if s.copyEngine == CopyEngineSkopeo {
+		err = s.skopeoPull(r.Context(), o, op, from, platform, dockerCfg)
+	} else {
+		err = s.registryPull(r.Context(), o, op, fromImage, pullTag, platform, dockerCfg)
+	}
 	if err != nil {
 		log.Printf("execute pull: %v", err)
-		o.Errorf("execute pull: %v", err)
+		o.ErrorCode(exitCode(err), fmt.Sprintf("execute pull: %v", err))
 	}
 }
+
+// registryPull copies the image of the platform requested by the client or
+// configured as defaultPlatform. Without either linux/amd64 is preferred.
+func (s Service) registryPull(ctx context.Context, o *output, op operation, fromImage, pullTag, platform string, dockerCfg dockerConfig) error {
+	release, err := enqueue(ctx, s.skopeoJobs, op, o)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// like the jobs, the execution time starts after waiting in the queue
+	ctx, cancel := context.WithTimeout(ctx, s.config().timeout(op))
+	defer cancel()
+
+	host, repo := remoteImage(fromImage)
+	src := s.remoteRegistry(host, dockerCfg)
+
+	m, err := src.getManifest(ctx, repo, pullTag)
+	if err != nil {
+		return err
+	}
+
+	image, _, err := src.imageManifest(ctx, repo, m, platform)
+	if err != nil {
+		return err
+	}
+
+	from := fmt.Sprintf("%s:%s", fromImage, pullTag)
+	toRepo, toTag := localImage(from)
+
+	c := newImageCopy(o, pullAction, src, repo, s.localRegistry(), toRepo)
+
+	err = c.copy(ctx, image, toTag)
+	if err != nil {
+		return err
+	}
+
+	err = o.Status("", fmt.Sprintf("Digest: %s", m.digest))
+	if err != nil {
+		return err
+	}
+
+	if !c.transferred {
+		return o.Status("", fmt.Sprintf("Status: Image is up to date for %s", from))
+	}
+
+	return o.Status("", fmt.Sprintf("Status: Downloaded newer image for %s", from))
+}
+
+// skopeoPull copies the image of the platform requested by the client or
+// configured as defaultPlatform. Without either linux/amd64 is copied, not the
+// platform of the node running skopeo.
+func (s Service) skopeoPull(ctx context.Context, o *output, op operation, from, platform string, dockerCfg dockerConfig) error {
+	to := fmt.Sprintf("%s/images/%s", s.config().Registry, escapePort(from))
+
+	if platform == "" {
+		platform = defaultPlatform
+	}
+
+	system, arch, variant := splitPlatform(platform)
+	override := fmt.Sprintf("--override-os %s --override-arch %s", system, arch)
+	if variant != "" {
+		override += fmt.Sprintf(" --override-variant %s", variant)
+	}
+
+	script := fmt.Sprintf(`
+set -euo pipefail
+skopeo inspect --raw --retry-times 3 docker://%s > /tmp/manifest
+echo "%ssha256:$(sha256sum /tmp/manifest | cut -d ' ' -f 1)"
+skopeo %s copy --retry-times 3 --dest-tls-verify=false docker://%s docker://%s
+`, from, digestMarker, override, from, to)
+
+	p := newSkopeoProgress(o, pullAction)
+
+	err := s.runSkopeoJob(ctx, p, op, script, dockerCfg.mustToJSON())
+	if err != nil {
+		p.Flush()
+		return err
+	}
+
+	err = p.Flush()
+	if err != nil {
+		return err
+	}
+
+	return p.finishPull(from)
+}
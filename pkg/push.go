@@ -1,6 +1,7 @@
 package wedding
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
@@ -12,8 +13,14 @@ func (s Service) pushImage(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	args := r.URL.Query()
 
-	from := fmt.Sprintf("wedding-registry:5000/images/%s:%s", escapePort(vars["name"]), args.Get("tag"))
-	to := fmt.Sprintf("%s:%s", vars["name"], args.Get("tag"))
+	name := vars["name"]
+	tag := args.Get("tag")
+
+	source := fmt.Sprintf("%s:%s", name, tag)
+	if tag == "" {
+		source = name
+		tag = "latest"
+	}
 
 	dockerCfg, err := xRegistryAuth(r.Header.Get("X-Registry-Auth")).toDockerConfig()
 	if err != nil {
@@ -23,13 +30,108 @@ func (s Service) pushImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO only use --dest-tls-verify=false for local registry
-	script := fmt.Sprintf(`skopeo copy --retry-times 3 --src-tls-verify=false --dest-tls-verify=false docker://%s docker://%s`, from, to)
+	op, err := newOperation(pushAction, r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
 
 	o := &output{w: w}
-	err = s.runSkopeoPod(r.Context(), o, "push", script, dockerCfg.mustToJSON())
+
+	err = o.Status("", fmt.Sprintf("The push refers to repository [%s]", name))
+	if err != nil {
+		log.Printf("execute push: %v", err)
+		return
+	}
+
+	fromRepo, fromReference, err := s.resolveImage(r.Context(), source)
+	if err == nil && fromRepo == imageIDRepo {
+		// like dockerd, push only by name, the image ID does not name a repository
+		err = fmt.Errorf("An image does not exist locally with the tag: %s", name)
+	}
 	if err != nil {
 		log.Printf("execute push: %v", err)
-		o.Errorf("execute push: %v", err)
+		o.ErrorCode(exitCode(err), fmt.Sprintf("execute push: %v", err))
+		return
+	}
+
+	if s.copyEngine == CopyEngineSkopeo {
+		err = s.skopeoPush(r.Context(), o, op, fromRepo, fromReference, name, tag, dockerCfg)
+	} else {
+		err = s.registryPush(r.Context(), o, op, fromRepo, fromReference, name, tag, dockerCfg)
+	}
+	if err != nil {
+		log.Printf("execute push: %v", err)
+		o.ErrorCode(exitCode(err), fmt.Sprintf("execute push: %v", err))
 	}
 }
+
+func (s Service) registryPush(ctx context.Context, o *output, op operation, fromRepo, fromReference, name, tag string, dockerCfg dockerConfig) error {
+	release, err := enqueue(ctx, s.skopeoJobs, op, o)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// like the jobs, the execution time starts after waiting in the queue
+	ctx, cancel := context.WithTimeout(ctx, s.config().timeout(op))
+	defer cancel()
+
+	m, err := s.localRegistry().getManifest(ctx, fromRepo, fromReference)
+	if err != nil {
+		return err
+	}
+
+	host, repo := remoteImage(name)
+	dst := s.remoteRegistry(host, dockerCfg)
+
+	c := newImageCopy(o, pushAction, s.localRegistry(), fromRepo, dst, repo)
+
+	err = c.copy(ctx, m, tag)
+	if err != nil {
+		return err
+	}
+
+	err = o.Status("", fmt.Sprintf("%s: digest: %s size: %d", tag, m.digest, len(m.body)))
+	if err != nil {
+		return err
+	}
+
+	return o.Aux(pushResult{
+		Tag:    tag,
+		Digest: m.digest,
+		Size:   len(m.body),
+	})
+}
+
+func (s Service) skopeoPush(ctx context.Context, o *output, op operation, fromRepo, fromReference, name, tag string, dockerCfg dockerConfig) error {
+	from := s.localReference(fromRepo, fromReference)
+	to := fmt.Sprintf("%s:%s", name, tag)
+
+	// only the local registry is served without tls
+	host, _ := remoteImage(name)
+	verify := host != s.config().Registry
+
+	script := fmt.Sprintf(`
+set -euo pipefail
+skopeo copy --retry-times 3 --digestfile /tmp/digest --src-tls-verify=false --dest-tls-verify=%t docker://%s docker://%s
+echo "%s$(cat /tmp/digest)"
+echo "%s$(skopeo inspect --raw --retry-times 3 --tls-verify=%t docker://%s@$(cat /tmp/digest) | wc -c)"
+`, verify, from, to, digestMarker, sizeMarker, verify, name)
+
+	p := newSkopeoProgress(o, pushAction)
+
+	err := s.runSkopeoJob(ctx, p, op, script, dockerCfg.mustToJSON())
+	if err != nil {
+		p.Flush()
+		return err
+	}
+
+	err = p.Flush()
+	if err != nil {
+		return err
+	}
+
+	return p.finishPush(tag)
+}
@@ -0,0 +1,713 @@
+package wedding
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	// defaultPlatform is selected from manifest lists if the request has no platform.
+	defaultPlatform = "linux/amd64"
+
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+)
+
+var (
+	errNotFound = errors.New("not found")
+
+	// errNotReplayable reports a streamed request the registry asked to authenticate.
+	// The registry is authenticated now, the request needs to be started again.
+	errNotReplayable = errors.New("request body can not be sent again")
+)
+
+// registry talks to a container registry using the registry v2 http api.
+type registry struct {
+	host     string
+	scheme   string
+	client   *http.Client
+	username string
+	password string
+
+	mu    sync.Mutex
+	basic bool
+	token string
+}
+
+type manifest struct {
+	mediaType string
+	digest    string
+	body      []byte
+}
+
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+	Platform  *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+		Variant      string `json:"variant,omitempty"`
+	} `json:"platform,omitempty"`
+}
+
+// manifestContent contains the fields of image manifests and manifest lists wedding needs.
+type manifestContent struct {
+	MediaType string       `json:"mediaType"`
+	Config    descriptor   `json:"config"`
+	Layers    []descriptor `json:"layers"`
+	Manifests []descriptor `json:"manifests"`
+}
+
+func newLocalRegistry(host string) *registry {
+	return &registry{
+		host:   host,
+		scheme: "http",
+		client: &http.Client{},
+	}
+}
+
+// newRemoteRegistry creates a client for the registry hosting the image.
+func newRemoteRegistry(host string, cfg dockerConfig) *registry {
+	username, password := cfg.credentials(host)
+
+	return &registry{
+		host:     host,
+		scheme:   "https",
+		client:   &http.Client{},
+		username: username,
+		password: password,
+	}
+}
+
+// remoteRegistry creates a client for the registry hosting the image.
+// The local registry is reached by http.
+func (s Service) remoteRegistry(host string, cfg dockerConfig) *registry {
+	r := newRemoteRegistry(host, cfg)
+	if host == s.config().Registry {
+		r.scheme = "http"
+	}
+
+	return r
+}
+
+func (r *registry) url(format string, args ...interface{}) string {
+	return fmt.Sprintf("%s://%s/v2/%s", r.scheme, r.host, fmt.Sprintf(format, args...))
+}
+
+// do executes the request and authenticates on demand.
+func (r *registry) do(req *http.Request) (*http.Response, error) {
+	r.authorize(req)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+
+	err = r.authenticate(req.Context(), challenge)
+	if err != nil {
+		return nil, fmt.Errorf("authenticate to %s: %v", r.host, err)
+	}
+
+	retry := req.Clone(req.Context())
+	if req.Body != nil {
+		if req.GetBody == nil {
+			return nil, fmt.Errorf("authenticate to %s: %w", r.host, errNotReplayable)
+		}
+
+		retry.Body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r.authorize(retry)
+
+	return r.client.Do(retry)
+}
+
+func (r *registry) authorize(req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch {
+	case r.token != "":
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", r.token))
+	case r.basic:
+		req.SetBasicAuth(r.username, r.password)
+	}
+}
+
+func (r *registry) authenticate(ctx context.Context, challenge string) error {
+	scheme, params := parseChallenge(challenge)
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if r.username == "" && r.password == "" {
+			return fmt.Errorf("credentials required")
+		}
+
+		r.mu.Lock()
+		r.basic = true
+		r.mu.Unlock()
+
+		return nil
+
+	case "bearer":
+		token, err := r.fetchToken(ctx, params)
+		if err != nil {
+			return err
+		}
+
+		r.mu.Lock()
+		r.token = token
+		r.mu.Unlock()
+
+		return nil
+	}
+
+	return fmt.Errorf("unsupported authentication challenge '%s'", challenge)
+}
+
+func (r *registry) fetchToken(ctx context.Context, params map[string]string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("invalid token realm '%s'", params["realm"])
+	}
+
+	query := realm.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	for _, scope := range strings.Fields(params["scope"]) {
+		query.Add("scope", scope)
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	if r.username != "" || r.password != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("request token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("request token: %s", responseError(resp))
+	}
+
+	token := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return "", fmt.Errorf("decode token: %v", err)
+	}
+
+	if token.Token != "" {
+		return token.Token, nil
+	}
+
+	return token.AccessToken, nil
+}
+
+// parseChallenge parses a WWW-Authenticate header like
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull"
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := map[string]string{}
+
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(parts) != 2 {
+		return parts[0], params
+	}
+
+	rest := parts[1]
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq == -1 {
+			break
+		}
+
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = strings.TrimSpace(rest[eq+1:])
+
+		value := ""
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end == -1 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			end := strings.Index(rest, ",")
+			if end == -1 {
+				value, rest = rest, ""
+			} else {
+				value, rest = rest[:end], rest[end:]
+			}
+		}
+
+		params[key] = value
+		rest = strings.TrimPrefix(strings.TrimSpace(rest), ",")
+	}
+
+	return parts[0], params
+}
+
+func (r *registry) getManifest(ctx context.Context, repo, reference string) (*manifest, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url("%s/manifests/%s", repo, reference), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", strings.Join([]string{
+		mediaTypeDockerManifest,
+		mediaTypeDockerManifestList,
+		mediaTypeOCIManifest,
+		mediaTypeOCIIndex,
+	}, ", "))
+
+	resp, err := r.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("get manifest %s:%s: %v", repo, reference, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("manifest %s:%s: %w", repo, reference, errNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get manifest %s:%s: %s", repo, reference, responseError(resp))
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read manifest %s:%s: %v", repo, reference, err)
+	}
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		digest = fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+	}
+
+	return &manifest{
+		mediaType: resp.Header.Get("Content-Type"),
+		digest:    digest,
+		body:      body,
+	}, nil
+}
+
+func (r *registry) manifestExists(ctx context.Context, repo, reference string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, r.url("%s/manifests/%s", repo, reference), nil)
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Accept", strings.Join([]string{
+		mediaTypeDockerManifest,
+		mediaTypeDockerManifestList,
+		mediaTypeOCIManifest,
+		mediaTypeOCIIndex,
+	}, ", "))
+
+	resp, err := r.do(req)
+	if err != nil {
+		return false, fmt.Errorf("look up manifest %s:%s: %v", repo, reference, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+
+	return false, fmt.Errorf("look up manifest %s:%s: %s", repo, reference, resp.Status)
+}
+
+// listTags returns the tags of a repository, none if the repository does not exist.
+func (r *registry) listTags(ctx context.Context, repo string) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url("%s/tags/list", repo), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("list tags %s: %v", repo, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return []string{}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("list tags %s: %s", repo, responseError(resp))
+	}
+
+	tags := struct {
+		Tags []string `json:"tags"`
+	}{}
+
+	err = json.NewDecoder(resp.Body).Decode(&tags)
+	if err != nil {
+		return nil, fmt.Errorf("decode tags %s: %v", repo, err)
+	}
+
+	return tags.Tags, nil
+}
+
+func (r *registry) putManifest(ctx context.Context, repo, reference string, m *manifest) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, r.url("%s/manifests/%s", repo, reference), bytes.NewReader(m.body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", m.mediaType)
+
+	resp, err := r.do(req)
+	if err != nil {
+		return fmt.Errorf("put manifest %s:%s: %v", repo, reference, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("put manifest %s:%s: %s", repo, reference, responseError(resp))
+	}
+
+	return nil
+}
+
+func (r *registry) getBlob(ctx context.Context, repo, digest string) ([]byte, error) {
+	blob, err := r.openBlob(ctx, repo, digest)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+
+	body, err := ioutil.ReadAll(blob)
+	if err != nil {
+		return nil, fmt.Errorf("read blob %s: %v", digest, err)
+	}
+
+	if fmt.Sprintf("sha256:%x", sha256.Sum256(body)) != digest {
+		return nil, fmt.Errorf("blob %s: digest mismatch", digest)
+	}
+
+	return body, nil
+}
+
+func (r *registry) openBlob(ctx context.Context, repo, digest string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url("%s/blobs/%s", repo, digest), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("get blob %s: %v", digest, err)
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("blob %s: %w", digest, errNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, fmt.Errorf("get blob %s: %s", digest, responseError(resp))
+	}
+
+	return resp.Body, nil
+}
+
+func (r *registry) blobExists(ctx context.Context, repo, digest string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, r.url("%s/blobs/%s", repo, digest), nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := r.do(req)
+	if err != nil {
+		return false, fmt.Errorf("look up blob %s: %v", digest, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+
+	return false, fmt.Errorf("look up blob %s: %s", digest, resp.Status)
+}
+
+// startUpload starts a blob upload. If fromRepo is set the registry is asked to
+// mount the blob from there instead. A mounted blob requires no upload.
+func (r *registry) startUpload(ctx context.Context, repo, fromRepo, digest string) (bool, string, error) {
+	endpoint := r.url("%s/blobs/uploads/", repo)
+	if fromRepo != "" {
+		endpoint = r.url("%s/blobs/uploads/?mount=%s&from=%s", repo, url.QueryEscape(digest), url.QueryEscape(fromRepo))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, nil)
+	if err != nil {
+		return false, "", err
+	}
+
+	resp, err := r.do(req)
+	if err != nil {
+		return false, "", fmt.Errorf("start upload of blob %s: %v", digest, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return true, "", nil
+	case http.StatusAccepted:
+		location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+		if err != nil {
+			return false, "", fmt.Errorf("parse upload location of blob %s: %v", digest, err)
+		}
+		return false, location.String(), nil
+	}
+
+	return false, "", fmt.Errorf("start upload of blob %s: %s", digest, responseError(resp))
+}
+
+// uploadBlob completes an upload started by startUpload in a single request.
+// The blob is streamed, if the registry asks to authenticate errNotReplayable
+// is returned and the upload needs to be started again.
+func (r *registry) uploadBlob(ctx context.Context, location, digest string, size int64, blob io.Reader) error {
+	endpoint, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+
+	query := endpoint.Query()
+	query.Set("digest", digest)
+	endpoint.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, endpoint.String(), blob)
+	if err != nil {
+		return err
+	}
+
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := r.do(req)
+	if err != nil {
+		return fmt.Errorf("upload blob %s: %w", digest, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("upload blob %s: %s", digest, responseError(resp))
+	}
+
+	return nil
+}
+
+// mountBlob links a blob from one repository into another without transferring it.
+func (r *registry) mountBlob(ctx context.Context, repo, fromRepo, digest string) error {
+	mounted, _, err := r.startUpload(ctx, repo, fromRepo, digest)
+	if err != nil {
+		return err
+	}
+
+	if !mounted {
+		return fmt.Errorf("mount blob %s from %s: not supported by registry", digest, fromRepo)
+	}
+
+	return nil
+}
+
+// copyManifest makes the manifest available as reference in repo.
+// Blobs and nested manifests are mounted from fromRepo.
+func (r *registry) copyManifest(ctx context.Context, fromRepo, repo, reference string, m *manifest) error {
+	if fromRepo != repo {
+		content, err := m.content()
+		if err != nil {
+			return err
+		}
+
+		for _, child := range content.Manifests {
+			childManifest, err := r.getManifest(ctx, fromRepo, child.Digest)
+			if err != nil {
+				return err
+			}
+
+			err = r.copyManifest(ctx, fromRepo, repo, child.Digest, childManifest)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, blob := range content.blobs() {
+			err = r.mountBlob(ctx, repo, fromRepo, blob.Digest)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return r.putManifest(ctx, repo, reference, m)
+}
+
+// imageManifest resolves manifest lists to the image manifest of the platform,
+// linux/amd64 if empty.
+func (r *registry) imageManifest(ctx context.Context, repo string, m *manifest, platform string) (*manifest, *manifestContent, error) {
+	content, err := m.content()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(content.Manifests) == 0 {
+		return m, content, nil
+	}
+
+	selected, err := selectPlatform(content.Manifests, platform)
+	if err != nil {
+		return nil, nil, fmt.Errorf("manifest list %s: %v", m.digest, err)
+	}
+
+	child, err := r.getManifest(ctx, repo, selected.Digest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return r.imageManifest(ctx, repo, child, platform)
+}
+
+// selectPlatform picks the manifest of the platform from a manifest list.
+// Without variant any variant of the architecture matches.
+// Without platform linux/amd64 is preferred, otherwise the first manifest is used.
+func selectPlatform(manifests []descriptor, platform string) (descriptor, error) {
+	requested := platform
+	if requested == "" {
+		platform = defaultPlatform
+	}
+
+	system, arch, variant := splitPlatform(platform)
+
+	for _, child := range manifests {
+		if child.Platform == nil || child.Platform.OS != system || child.Platform.Architecture != arch {
+			continue
+		}
+
+		if variant == "" || child.Platform.Variant == variant {
+			return child, nil
+		}
+	}
+
+	if requested == "" {
+		return manifests[0], nil
+	}
+
+	return descriptor{}, fmt.Errorf("no image for platform %s", platform)
+}
+
+// splitPlatform splits os/arch/variant, the os defaults to linux.
+func splitPlatform(platform string) (string, string, string) {
+	parts := strings.SplitN(platform, "/", 3)
+
+	switch len(parts) {
+	case 1:
+		return "linux", parts[0], ""
+	case 2:
+		return parts[0], parts[1], ""
+	}
+
+	return parts[0], parts[1], parts[2]
+}
+
+func (m manifest) content() (*manifestContent, error) {
+	content := &manifestContent{}
+
+	err := json.Unmarshal(m.body, content)
+	if err != nil {
+		return nil, fmt.Errorf("decode manifest %s: %v", m.digest, err)
+	}
+
+	return content, nil
+}
+
+func (c manifestContent) blobs() []descriptor {
+	if c.Config.Digest == "" {
+		return c.Layers
+	}
+
+	return append([]descriptor{c.Config}, c.Layers...)
+}
+
+func responseError(resp *http.Response) string {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Sprintf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+// remoteImage splits an image name into the registry host and the repository.
+func remoteImage(name string) (string, string) {
+	host, repo := "docker.io", name
+
+	if idx := strings.Index(name, "/"); idx != -1 {
+		first := name[:idx]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			host, repo = first, name[idx+1:]
+		}
+	}
+
+	if host == "docker.io" || host == "index.docker.io" {
+		host = "registry-1.docker.io"
+		if !strings.Contains(repo, "/") {
+			repo = fmt.Sprintf("library/%s", repo)
+		}
+	}
+
+	return host, repo
+}
+
+// localImage returns the repository and tag wedding uses to store an image in the local registry.
+func localImage(name string) (string, string) {
+	repo, tag := splitTag(escapePort(name))
+	return fmt.Sprintf("images/%s", repo), tag
+}
+
+// splitTag separates the tag from an image name, defaulting to latest.
+func splitTag(name string) (string, string) {
+	if idx := strings.LastIndex(name, ":"); idx > strings.LastIndex(name, "/") {
+		return name[:idx], name[idx+1:]
+	}
+
+	return name, "latest"
+}
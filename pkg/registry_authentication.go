@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
 )
 
 type xRegistryConfig string
@@ -27,6 +28,43 @@ func (d dockerConfig) mustToJSON() string {
 	return string(bytes)
 }
 
+// credentials looks up username and password for a registry host.
+func (d dockerConfig) credentials(host string) (string, string) {
+	for server, auth := range d.Auths {
+		if registryHost(server) != registryHost(host) {
+			continue
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			log.Printf("decode credentials for %s: %v", server, err)
+			continue
+		}
+
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		return parts[0], parts[1]
+	}
+
+	return "", ""
+}
+
+// registryHost normalizes server addresses like https://index.docker.io/v1/ to a host.
+func registryHost(server string) string {
+	host := strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+	host = strings.SplitN(host, "/", 2)[0]
+
+	switch host {
+	case "docker.io", "index.docker.io", "registry-1.docker.io":
+		return "registry-1.docker.io"
+	}
+
+	return host
+}
+
 func (x xRegistryConfig) toDockerConfig() (dockerConfig, error) {
 	js, err := base64.StdEncoding.DecodeString(string(x))
 	if err != nil {
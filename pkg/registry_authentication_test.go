@@ -51,19 +51,19 @@ func Test_dockerConfig_mustToJSON(t *testing.T) {
 	tests := []struct {
 		name  string
 		auths map[string]dockerAuth
-		want  []byte
+		want  string
 	}{
 		{
 			name:  "empty",
 			auths: map[string]dockerAuth{},
-			want:  []byte(`{"auths":{}}`),
+			want:  `{"auths":{}}`,
 		},
 		{
 			name: "logged in",
 			auths: map[string]dockerAuth{"reg": {
 				Auth: base64.StdEncoding.EncodeToString([]byte("user:pass123")),
 			}},
-			want: []byte(`{"auths":{"reg":{"auth":"dXNlcjpwYXNzMTIz"}}}`),
+			want: `{"auths":{"reg":{"auth":"dXNlcjpwYXNzMTIz"}}}`,
 		},
 	}
 
@@ -78,3 +78,48 @@ func Test_dockerConfig_mustToJSON(t *testing.T) {
 		})
 	}
 }
+
+func Test_dockerConfig_credentials(t *testing.T) {
+	d := dockerConfig{
+		Auths: map[string]dockerAuth{
+			"https://index.docker.io/v1/": {
+				Auth: base64.StdEncoding.EncodeToString([]byte("hub:pass:word")),
+			},
+			"reg.domain.tld": {
+				Auth: base64.StdEncoding.EncodeToString([]byte("user:pass123")),
+			},
+		},
+	}
+
+	tests := []struct {
+		name         string
+		host         string
+		wantUsername string
+		wantPassword string
+	}{
+		{
+			name:         "docker hub",
+			host:         "registry-1.docker.io",
+			wantUsername: "hub",
+			wantPassword: "pass:word",
+		},
+		{
+			name:         "registry",
+			host:         "reg.domain.tld",
+			wantUsername: "user",
+			wantPassword: "pass123",
+		},
+		{
+			name: "unknown",
+			host: "wedding-registry:5000",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotUsername, gotPassword := d.credentials(tt.host)
+			if gotUsername != tt.wantUsername || gotPassword != tt.wantPassword {
+				t.Errorf("dockerConfig.credentials() = %v, %v, want %v, %v", gotUsername, gotPassword, tt.wantUsername, tt.wantPassword)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package wedding
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func Test_localImage(t *testing.T) {
+	tests := []struct {
+		name     string
+		image    string
+		wantRepo string
+		wantTag  string
+	}{
+		{
+			name:     "short",
+			image:    "alpine",
+			wantRepo: "images/alpine",
+			wantTag:  "latest",
+		},
+		{
+			name:     "tagged",
+			image:    "library/alpine:3.13",
+			wantRepo: "images/library/alpine",
+			wantTag:  "3.13",
+		},
+		{
+			name:     "registry with port",
+			image:    "wedding-registry:5000/test-push:alpine",
+			wantRepo: "images/wedding-registry_5000/test-push",
+			wantTag:  "alpine",
+		},
+		{
+			name:     "registry with port without tag",
+			image:    "registry:5000/user/image",
+			wantRepo: "images/registry_5000/user/image",
+			wantTag:  "latest",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotRepo, gotTag := localImage(tt.image)
+			if gotRepo != tt.wantRepo {
+				t.Errorf("localImage() repo = %v, want %v", gotRepo, tt.wantRepo)
+			}
+			if gotTag != tt.wantTag {
+				t.Errorf("localImage() tag = %v, want %v", gotTag, tt.wantTag)
+			}
+		})
+	}
+}
+
+func Test_parseChallenge(t *testing.T) {
+	tests := []struct {
+		name       string
+		challenge  string
+		wantScheme string
+		wantParams map[string]string
+	}{
+		{
+			name:       "bearer",
+			challenge:  `Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull"`,
+			wantScheme: "Bearer",
+			wantParams: map[string]string{
+				"realm":   "https://auth.docker.io/token",
+				"service": "registry.docker.io",
+				"scope":   "repository:library/alpine:pull",
+			},
+		},
+		{
+			name:       "basic",
+			challenge:  `Basic realm=Registry`,
+			wantScheme: "Basic",
+			wantParams: map[string]string{
+				"realm": "Registry",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotScheme, gotParams := parseChallenge(tt.challenge)
+			if gotScheme != tt.wantScheme {
+				t.Errorf("parseChallenge() scheme = %v, want %v", gotScheme, tt.wantScheme)
+			}
+			if !reflect.DeepEqual(gotParams, tt.wantParams) {
+				t.Errorf("parseChallenge() params = %v, want %v", gotParams, tt.wantParams)
+			}
+		})
+	}
+}
+
+func Test_remoteImage(t *testing.T) {
+	tests := []struct {
+		image    string
+		wantHost string
+		wantRepo string
+	}{
+		{image: "alpine", wantHost: "registry-1.docker.io", wantRepo: "library/alpine"},
+		{image: "davedamoon/wedding", wantHost: "registry-1.docker.io", wantRepo: "davedamoon/wedding"},
+		{image: "docker.io/alpine", wantHost: "registry-1.docker.io", wantRepo: "library/alpine"},
+		{image: "wedding-registry:5000/test-push", wantHost: "wedding-registry:5000", wantRepo: "test-push"},
+		{image: "ghcr.io/utopia-planitia/skopeo-image", wantHost: "ghcr.io", wantRepo: "utopia-planitia/skopeo-image"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			gotHost, gotRepo := remoteImage(tt.image)
+			if gotHost != tt.wantHost || gotRepo != tt.wantRepo {
+				t.Errorf("remoteImage() = %v, %v, want %v, %v", gotHost, gotRepo, tt.wantHost, tt.wantRepo)
+			}
+		})
+	}
+}
+
+func Test_selectPlatform(t *testing.T) {
+	content := manifestContent{}
+	err := json.Unmarshal([]byte(`{"manifests": [
+		{"digest": "sha256:arm", "platform": {"os": "linux", "architecture": "arm", "variant": "v7"}},
+		{"digest": "sha256:arm64", "platform": {"os": "linux", "architecture": "arm64", "variant": "v8"}},
+		{"digest": "sha256:amd64", "platform": {"os": "linux", "architecture": "amd64"}}
+	]}`), &content)
+	if err != nil {
+		t.Fatalf("decode manifest list: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		platform string
+		want     string
+		wantErr  bool
+	}{
+		{name: "default", platform: "", want: "sha256:amd64"},
+		{name: "arm64", platform: "linux/arm64", want: "sha256:arm64"},
+		{name: "variant", platform: "linux/arm/v7", want: "sha256:arm"},
+		{name: "other variant", platform: "linux/arm/v6", wantErr: true},
+		{name: "missing", platform: "linux/s390x", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := selectPlatform(content.Manifests, tt.platform)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectPlatform() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got.Digest != tt.want {
+				t.Errorf("selectPlatform() = %v, want %v", got.Digest, tt.want)
+			}
+		})
+	}
+
+	got, err := selectPlatform(content.Manifests[:2], "")
+	if err != nil || got.Digest != "sha256:arm" {
+		t.Errorf("selectPlatform() without amd64 = %v, %v, want the first manifest", got.Digest, err)
+	}
+}
@@ -0,0 +1,232 @@
+package wedding
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	tenantHeader   = "X-Wedding-Tenant"
+	priorityHeader = "X-Wedding-Priority"
+
+	priorityLow    = 0
+	priorityNormal = 1
+	priorityHigh   = 2
+)
+
+var priorities = map[string]int{
+	"low":    priorityLow,
+	"normal": priorityNormal,
+	"high":   priorityHigh,
+}
+
+// scheduler limits the number of concurrent jobs of a kind.
+// Waiting requests with a higher priority are admitted first. Within a priority
+// the tenant with the fewest admitted jobs goes next, so a single tenant can not
+// starve the others by queueing many requests.
+type scheduler struct {
+	mu      sync.Mutex
+	limit   int
+	running int
+	tenants map[string]int
+	waiting []*ticket
+	seq     uint64
+}
+
+type ticket struct {
+	tenant   string
+	priority int
+	seq      uint64
+	admitted chan struct{}
+	changed  chan struct{}
+}
+
+func newScheduler(limit int) *scheduler {
+	return &scheduler{
+		limit:   limit,
+		tenants: map[string]int{},
+	}
+}
+
+// acquire blocks until a slot is free and the request is next in line.
+// While waiting, report is called with the current queue position, starting at 1.
+func (s *scheduler) acquire(ctx context.Context, tenant string, priority int, report func(position int)) (func(), error) {
+	s.mu.Lock()
+
+	s.seq++
+	t := &ticket{
+		tenant:   tenant,
+		priority: priority,
+		seq:      s.seq,
+		admitted: make(chan struct{}),
+		changed:  make(chan struct{}, 1),
+	}
+	s.waiting = append(s.waiting, t)
+	s.admit()
+
+	s.mu.Unlock()
+
+	release := func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.running--
+		s.tenants[tenant]--
+		if s.tenants[tenant] == 0 {
+			delete(s.tenants, tenant)
+		}
+
+		s.admit()
+	}
+
+	reported := 0
+
+	for {
+		select {
+		case <-t.admitted:
+			return release, nil
+
+		case <-ctx.Done():
+			s.mu.Lock()
+
+			select {
+			case <-t.admitted:
+				// admitted while giving up, hand the slot to the next request
+				s.mu.Unlock()
+				release()
+			default:
+				s.remove(t)
+				s.admit()
+				s.mu.Unlock()
+			}
+
+			return nil, ctx.Err()
+
+		case <-t.changed:
+			s.mu.Lock()
+			position := s.position(t)
+			s.mu.Unlock()
+
+			if position != 0 && position != reported {
+				reported = position
+				report(position)
+			}
+		}
+	}
+}
+
+// setLimit changes the number of concurrent jobs, running jobs are not interrupted.
+func (s *scheduler) setLimit(limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.limit = limit
+	s.admit()
+}
+
+// admit hands free slots to the waiting requests in queue order
+// and notifies the remaining ones about their new position.
+func (s *scheduler) admit() {
+	s.sort()
+
+	for s.running < s.limit && len(s.waiting) != 0 {
+		t := s.waiting[0]
+		s.waiting = s.waiting[1:]
+
+		s.running++
+		s.tenants[t.tenant]++
+		close(t.admitted)
+
+		s.sort()
+	}
+
+	for _, t := range s.waiting {
+		select {
+		case t.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// sort orders the waiting requests by priority and then by the number of
+// jobs their tenant would already run, assuming its earlier requests are admitted.
+func (s *scheduler) sort() {
+	ahead := map[string]int{}
+	share := map[*ticket]int{}
+
+	sort.SliceStable(s.waiting, func(i, j int) bool {
+		return s.waiting[i].seq < s.waiting[j].seq
+	})
+
+	for _, t := range s.waiting {
+		share[t] = s.tenants[t.tenant] + ahead[t.tenant]
+		ahead[t.tenant]++
+	}
+
+	sort.SliceStable(s.waiting, func(i, j int) bool {
+		a, b := s.waiting[i], s.waiting[j]
+
+		if a.priority != b.priority {
+			return a.priority > b.priority
+		}
+
+		return share[a] < share[b]
+	})
+}
+
+func (s *scheduler) position(t *ticket) int {
+	for idx, waiting := range s.waiting {
+		if waiting == t {
+			return idx + 1
+		}
+	}
+
+	return 0
+}
+
+func (s *scheduler) remove(t *ticket) {
+	for idx, waiting := range s.waiting {
+		if waiting == t {
+			s.waiting = append(s.waiting[:idx], s.waiting[idx+1:]...)
+			return
+		}
+	}
+}
+
+// enqueue waits for a free slot of the scheduler and streams the queue position to the client.
+func enqueue(ctx context.Context, sched *scheduler, op operation, w io.Writer) (func(), error) {
+	return sched.acquire(ctx, op.tenant, op.priority, func(position int) {
+		streamf(w, "Waiting for a free %s slot, position %d in queue\n", op.kind, position)
+	})
+}
+
+// requestTenant identifies the client sharing the queue fairly with others.
+// Clients without a tenant header are told apart by their address.
+func requestTenant(r *http.Request) string {
+	tenant := r.Header.Get(tenantHeader)
+	if tenant != "" {
+		return tenant
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// requestPriority reads the priority header, interactive clients like tilt send high.
+func requestPriority(r *http.Request) int {
+	priority, ok := priorities[strings.ToLower(r.Header.Get(priorityHeader))]
+	if !ok {
+		return priorityNormal
+	}
+
+	return priority
+}
@@ -0,0 +1,133 @@
+package wedding
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_scheduler(t *testing.T) {
+	ctx := context.Background()
+	s := newScheduler(1)
+
+	releaseFirst, err := s.acquire(ctx, "ci", priorityNormal, func(int) {})
+	if err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+
+	type result struct {
+		name    string
+		release func()
+	}
+	admitted := make(chan result, 3)
+
+	enqueue := func(name, tenant string, priority int) {
+		waiting := make(chan struct{})
+
+		go func() {
+			release, err := s.acquire(ctx, tenant, priority, func(position int) {
+				select {
+				case <-waiting:
+				default:
+					close(waiting)
+				}
+			})
+			if err != nil {
+				t.Errorf("acquire(%s) error = %v", name, err)
+				return
+			}
+			admitted <- result{name: name, release: release}
+		}()
+
+		select {
+		case <-waiting:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s not queued", name)
+		}
+	}
+
+	enqueue("ci-2", "ci", priorityNormal)
+	enqueue("other", "other", priorityNormal)
+	enqueue("tilt", "developer", priorityHigh)
+
+	s.mu.Lock()
+	order := []string{}
+	for _, ticket := range s.waiting {
+		order = append(order, ticket.tenant)
+	}
+	s.mu.Unlock()
+
+	want := []string{"developer", "other", "ci"}
+	for idx := range want {
+		if idx >= len(order) || order[idx] != want[idx] {
+			t.Fatalf("queue = %v, want %v", order, want)
+		}
+	}
+
+	// ci-2 is ahead of other once the first ci build finished
+	release := releaseFirst
+	for _, name := range []string{"tilt", "ci-2", "other"} {
+		release()
+
+		select {
+		case r := <-admitted:
+			if r.name != name {
+				t.Fatalf("admitted %s, want %s", r.name, name)
+			}
+			release = r.release
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s not admitted", name)
+		}
+	}
+	release()
+
+	if s.running != 0 || len(s.tenants) != 0 {
+		t.Errorf("scheduler not empty: running %d, tenants %v", s.running, s.tenants)
+	}
+}
+
+func Test_scheduler_cancel(t *testing.T) {
+	s := newScheduler(1)
+
+	release, err := s.acquire(context.Background(), "a", priorityNormal, func(int) {})
+	if err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = s.acquire(ctx, "b", priorityNormal, func(int) {})
+	if err != context.DeadlineExceeded {
+		t.Errorf("acquire() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if len(s.waiting) != 0 {
+		t.Errorf("waiting = %d, want cancelled request removed", len(s.waiting))
+	}
+
+	release()
+}
+
+func Test_requestPriority(t *testing.T) {
+	tests := []struct {
+		header string
+		want   int
+	}{
+		{header: "", want: priorityNormal},
+		{header: "high", want: priorityHigh},
+		{header: "Low", want: priorityLow},
+		{header: "urgent", want: priorityNormal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/build", nil)
+			r.Header.Set(priorityHeader, tt.header)
+
+			if got := requestPriority(r); got != tt.want {
+				t.Errorf("requestPriority() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
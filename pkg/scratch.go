@@ -0,0 +1,132 @@
+package wedding
+
+import (
+	"fmt"
+	"net/http"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	buildStorageHeader = "X-Wedding-Build-Storage"
+
+	scratchVolumeName = "scratch"
+	scratchPath       = "/scratch"
+
+	scratchEmptyDir  = "emptyDir"
+	scratchMemory    = "memory"
+	scratchEphemeral = "ephemeral"
+)
+
+var scratchVolumes = map[string]bool{
+	scratchEmptyDir:  true,
+	scratchMemory:    true,
+	scratchEphemeral: true,
+}
+
+// buildStorage reads the size of the scratch volume requested by the client,
+// up to the maximum of the config.
+func buildStorage(r *http.Request, defaults Config) (resource.Quantity, error) {
+	value := r.Header.Get(buildStorageHeader)
+	if value == "" {
+		return resource.MustParse(defaults.BuildStorage), nil
+	}
+
+	storage, err := resource.ParseQuantity(value)
+	if err != nil {
+		return storage, fmt.Errorf("parse %s: %v", buildStorageHeader, err)
+	}
+
+	max := resource.MustParse(defaults.MaxBuildStorage)
+	if storage.Sign() <= 0 || storage.Cmp(max) > 0 {
+		return storage, fmt.Errorf("%s %s is not between 0 and %s", buildStorageHeader, value, defaults.MaxBuildStorage)
+	}
+
+	return storage, nil
+}
+
+// addScratchVolume gives the build container a volume of the given size for
+// the build context and the buildkit state.
+// Disk backed volumes are limited by the ephemeral storage of the container,
+// memory backed volumes count towards its memory limit.
+func addScratchVolume(pod *corev1.Pod, config Config, size resource.Quantity) {
+	volume := corev1.Volume{Name: scratchVolumeName}
+	container := &pod.Spec.Containers[0]
+	resources := container.Resources
+
+	switch config.BuildScratchVolume {
+	case scratchMemory:
+		volume.EmptyDir = &corev1.EmptyDirVolumeSource{
+			Medium:    corev1.StorageMediumMemory,
+			SizeLimit: &size,
+		}
+
+		memory := resources.Limits[corev1.ResourceMemory]
+		memory.Add(size)
+		resources.Limits[corev1.ResourceMemory] = memory
+		resources.Requests[corev1.ResourceMemory] = memory
+
+	case scratchEphemeral:
+		var storageClass *string
+		if config.BuildStorageClass != "" {
+			storageClass = &config.BuildStorageClass
+		}
+
+		volume.Ephemeral = &corev1.EphemeralVolumeSource{
+			VolumeClaimTemplate: &corev1.PersistentVolumeClaimTemplate{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{"app": "wedding"},
+				},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+					StorageClassName: storageClass,
+					Resources: corev1.ResourceRequirements{
+						Requests: corev1.ResourceList{
+							corev1.ResourceStorage: size,
+						},
+					},
+				},
+			},
+		}
+
+		// freshly provisioned volumes belong to root, the build runs as the pod user
+		fsGroup := int64(config.PodSecurity.RunAsGroup)
+		if pod.Spec.SecurityContext == nil {
+			pod.Spec.SecurityContext = &corev1.PodSecurityContext{}
+		}
+		pod.Spec.SecurityContext.FSGroup = &fsGroup
+
+	default:
+		volume.EmptyDir = &corev1.EmptyDirVolumeSource{
+			SizeLimit: &size,
+		}
+
+		resources.Limits[corev1.ResourceEphemeralStorage] = size
+		resources.Requests[corev1.ResourceEphemeralStorage] = size
+	}
+
+	pod.Spec.Volumes = append(pod.Spec.Volumes, volume)
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		MountPath: scratchPath,
+		Name:      scratchVolumeName,
+	})
+}
+
+// scratchLimit returns the size of the scratch volume of a build pod.
+func scratchLimit(pod *corev1.Pod) string {
+	for _, volume := range pod.Spec.Volumes {
+		if volume.Name == scratchVolumeName && volume.EmptyDir != nil && volume.EmptyDir.SizeLimit != nil {
+			return volume.EmptyDir.SizeLimit.String()
+		}
+	}
+
+	for _, c := range pod.Spec.Containers {
+		if quantity, ok := c.Resources.Limits[corev1.ResourceEphemeralStorage]; ok {
+			return quantity.String()
+		}
+	}
+
+	return "unknown"
+}
@@ -0,0 +1,107 @@
+package wedding
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func Test_buildStorage(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    string
+		wantErr bool
+	}{
+		{name: "default", header: "", want: "10Gi"},
+		{name: "header", header: "20Gi", want: "20Gi"},
+		{name: "too large", header: "1Ti", wantErr: true},
+		{name: "invalid", header: "lots", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/build", nil)
+			if tt.header != "" {
+				r.Header.Set(buildStorageHeader, tt.header)
+			}
+
+			got, err := buildStorage(r, DefaultConfig())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("buildStorage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.String() != tt.want {
+				t.Errorf("buildStorage() = %v, want %v", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func Test_addScratchVolume(t *testing.T) {
+	tests := []struct {
+		volume               string
+		wantMemory           string
+		wantEphemeralStorage string
+		wantFSGroup          bool
+	}{
+		{volume: scratchEmptyDir, wantMemory: "2Gi", wantEphemeralStorage: "10Gi"},
+		{volume: scratchMemory, wantMemory: "12Gi"},
+		{volume: scratchEphemeral, wantMemory: "2Gi", wantFSGroup: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.volume, func(t *testing.T) {
+			pod := &corev1.Pod{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name: "buildkit",
+							Resources: corev1.ResourceRequirements{
+								Limits:   corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("2Gi")},
+								Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("2Gi")},
+							},
+						},
+					},
+				},
+			}
+
+			config := DefaultConfig()
+			config.BuildScratchVolume = tt.volume
+
+			config.PodSecurity.secure(pod, "buildkit")
+			addScratchVolume(pod, config, resource.MustParse("10Gi"))
+
+			fsGroup := pod.Spec.SecurityContext.FSGroup
+			if tt.wantFSGroup && (fsGroup == nil || *fsGroup != int64(config.PodSecurity.RunAsGroup)) {
+				t.Errorf("fsGroup = %v, want the group %d of the build", fsGroup, config.PodSecurity.RunAsGroup)
+			}
+			if !tt.wantFSGroup && fsGroup != nil {
+				t.Errorf("fsGroup = %v, want none", *fsGroup)
+			}
+
+			container := pod.Spec.Containers[0]
+			if len(container.VolumeMounts) != 1 || container.VolumeMounts[0].MountPath != scratchPath {
+				t.Errorf("volume mounts = %v, want the scratch volume", container.VolumeMounts)
+			}
+			if len(pod.Spec.Volumes) != 1 {
+				t.Fatalf("volumes = %v, want the scratch volume", pod.Spec.Volumes)
+			}
+			if tt.volume == scratchEphemeral && pod.Spec.Volumes[0].Ephemeral == nil {
+				t.Errorf("volume = %+v, want a generic ephemeral volume", pod.Spec.Volumes[0])
+			}
+
+			if got := container.Resources.Limits.Memory().String(); got != tt.wantMemory {
+				t.Errorf("memory limit = %v, want %v", got, tt.wantMemory)
+			}
+
+			got := ""
+			if quantity, ok := container.Resources.Limits[corev1.ResourceEphemeralStorage]; ok {
+				got = quantity.String()
+			}
+			if got != tt.wantEphemeralStorage {
+				t.Errorf("ephemeral storage limit = %v, want %v", got, tt.wantEphemeralStorage)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package wedding
+
+import (
+	"encoding/json"
+	"fmt"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const apparmorAnnotationPrefix = "container.apparmor.security.beta.kubernetes.io/"
+
+// PodSecurity configures the security context of build and skopeo pods.
+// Skopeo pods and build pods using the buildkitd pool comply with the Pod Security
+// "restricted" level. Rootless buildkit starting its own daemon needs seccomp and
+// AppArmor unconfined and setuid newuidmap, which only the "privileged" level allows.
+type PodSecurity struct {
+	RunAsUser          int  `json:"runAsUser" env:"WEDDING_POD_SECURITY_RUN_AS_USER"`
+	RunAsGroup         int  `json:"runAsGroup" env:"WEDDING_POD_SECURITY_RUN_AS_GROUP"`
+	UnconfinedBuildkit bool `json:"unconfinedBuildkit" env:"WEDDING_POD_SECURITY_UNCONFINED_BUILDKIT"`
+	HostUsers          bool `json:"hostUsers" env:"WEDDING_POD_SECURITY_HOST_USERS"`
+}
+
+func defaultPodSecurity() PodSecurity {
+	return PodSecurity{
+		// the user of the rootless buildkit image
+		RunAsUser:          1000,
+		RunAsGroup:         1000,
+		UnconfinedBuildkit: true,
+		HostUsers:          true,
+	}
+}
+
+func (p PodSecurity) validate() error {
+	if p.RunAsUser <= 0 {
+		return fmt.Errorf("podSecurity runAsUser %d is not a non-root user", p.RunAsUser)
+	}
+
+	if p.RunAsGroup < 0 {
+		return fmt.Errorf("podSecurity runAsGroup %d is negative", p.RunAsGroup)
+	}
+
+	return nil
+}
+
+func (p PodSecurity) podSecurityContext() *corev1.PodSecurityContext {
+	runAsNonRoot := true
+	runAsUser := int64(p.RunAsUser)
+	runAsGroup := int64(p.RunAsGroup)
+
+	return &corev1.PodSecurityContext{
+		RunAsNonRoot: &runAsNonRoot,
+		RunAsUser:    &runAsUser,
+		RunAsGroup:   &runAsGroup,
+	}
+}
+
+// restricted drops all capabilities and privilege escalation and uses the default seccomp profile.
+func (p PodSecurity) restricted() *corev1.SecurityContext {
+	allowPrivilegeEscalation := false
+
+	return &corev1.SecurityContext{
+		AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
+		},
+		SeccompProfile: &corev1.SeccompProfile{
+			Type: corev1.SeccompProfileTypeRuntimeDefault,
+		},
+	}
+}
+
+// secure sets the security context of the pod. The container named by unconfined
+// runs rootless buildkit and keeps the permissions rootlesskit needs, if enabled.
+func (p PodSecurity) secure(pod *corev1.Pod, unconfined string) {
+	pod.Spec.SecurityContext = p.podSecurityContext()
+
+	for idx := range pod.Spec.Containers {
+		container := &pod.Spec.Containers[idx]
+
+		if container.Name != unconfined || !p.UnconfinedBuildkit {
+			container.SecurityContext = p.restricted()
+			continue
+		}
+
+		container.SecurityContext = &corev1.SecurityContext{
+			SeccompProfile: &corev1.SeccompProfile{
+				Type: corev1.SeccompProfileTypeUnconfined,
+			},
+		}
+
+		if pod.Annotations == nil {
+			pod.Annotations = map[string]string{}
+		}
+		pod.Annotations[apparmorAnnotationPrefix+container.Name] = "unconfined"
+	}
+}
+
+// withoutHostUsers encodes the job with pods running in their own user namespace.
+// The hostUsers field is missing in the kubernetes api version wedding is built with.
+func withoutHostUsers(job *batchv1.Job) ([]byte, error) {
+	b, err := json.Marshal(job)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[string]interface{}{}
+
+	err = json.Unmarshal(b, &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	raw["apiVersion"] = batchv1.SchemeGroupVersion.String()
+	raw["kind"] = "Job"
+
+	spec := raw["spec"].(map[string]interface{})
+	template := spec["template"].(map[string]interface{})
+	podSpec := template["spec"].(map[string]interface{})
+	podSpec["hostUsers"] = false
+
+	return json.Marshal(raw)
+}
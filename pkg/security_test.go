@@ -0,0 +1,89 @@
+package wedding
+
+import (
+	"encoding/json"
+	"testing"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_PodSecurity_secure(t *testing.T) {
+	tests := []struct {
+		name           string
+		security       PodSecurity
+		unconfined     string
+		wantRestricted bool
+	}{
+		{name: "skopeo", security: defaultPodSecurity(), unconfined: "", wantRestricted: true},
+		{name: "rootless buildkit", security: defaultPodSecurity(), unconfined: "buildkit", wantRestricted: false},
+		{name: "confined buildkit", security: PodSecurity{RunAsUser: 1000, RunAsGroup: 1000}, unconfined: "buildkit", wantRestricted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "buildkit"}},
+				},
+			}
+
+			tt.security.secure(pod, tt.unconfined)
+
+			if !*pod.Spec.SecurityContext.RunAsNonRoot || *pod.Spec.SecurityContext.RunAsUser != 1000 {
+				t.Errorf("pod security context = %+v, want non-root user 1000", pod.Spec.SecurityContext)
+			}
+
+			container := pod.Spec.Containers[0].SecurityContext
+			restricted := container.SeccompProfile.Type == corev1.SeccompProfileTypeRuntimeDefault &&
+				container.AllowPrivilegeEscalation != nil && !*container.AllowPrivilegeEscalation &&
+				len(container.Capabilities.Drop) == 1 && container.Capabilities.Drop[0] == "ALL"
+			if restricted != tt.wantRestricted {
+				t.Errorf("container security context = %+v, restricted %v, want %v", container, restricted, tt.wantRestricted)
+			}
+
+			unconfinedAppArmor := pod.Annotations[apparmorAnnotationPrefix+"buildkit"] == "unconfined"
+			if unconfinedAppArmor == tt.wantRestricted {
+				t.Errorf("annotations = %v, unconfined AppArmor %v, want %v", pod.Annotations, unconfinedAppArmor, !tt.wantRestricted)
+			}
+		})
+	}
+}
+
+func Test_withoutHostUsers(t *testing.T) {
+	job := &batchv1.Job{}
+	job.Name = "wedding-build-a"
+	job.Spec.Template.Spec.Containers = []corev1.Container{{Name: "buildkit"}}
+
+	b, err := withoutHostUsers(job)
+	if err != nil {
+		t.Fatalf("withoutHostUsers() error = %v", err)
+	}
+
+	got := struct {
+		APIVersion string `json:"apiVersion"`
+		Kind       string `json:"kind"`
+		Spec       struct {
+			Template struct {
+				Spec struct {
+					HostUsers  *bool              `json:"hostUsers"`
+					Containers []corev1.Container `json:"containers"`
+				} `json:"spec"`
+			} `json:"template"`
+		} `json:"spec"`
+	}{}
+
+	err = json.Unmarshal(b, &got)
+	if err != nil {
+		t.Fatalf("decode job: %v", err)
+	}
+
+	if got.APIVersion != "batch/v1" || got.Kind != "Job" {
+		t.Errorf("type = %s %s, want batch/v1 Job", got.APIVersion, got.Kind)
+	}
+	if got.Spec.Template.Spec.HostUsers == nil || *got.Spec.Template.Spec.HostUsers {
+		t.Errorf("hostUsers = %v, want false", got.Spec.Template.Spec.HostUsers)
+	}
+	if len(got.Spec.Template.Spec.Containers) != 1 {
+		t.Errorf("containers = %v, want the buildkit container", got.Spec.Template.Spec.Containers)
+	}
+}
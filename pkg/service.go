@@ -7,43 +7,52 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
-	"golang.org/x/sync/semaphore"
-	"k8s.io/client-go/kubernetes"
 )
 
 const (
-	// MaxExecutionTime is the longest time allowed for a command to run.
-	MaxExecutionTime = 30 * time.Minute
-
-	apiVersion     = "1.40"
-	buildkitImage  = "moby/buildkit:v0.9.3-rootless"
-	skopeoImage    = "ghcr.io/utopia-planitia/skopeo-image@sha256:130836bd82e5f3a856f659e22f0e9d97c545ff0d955807b806595ec4874d5f37"
-	buildMemory    = "2147483648" // 2Gi default
-	buildCPUQuota  = 100_000      // results in 1 cpu
-	buildCPUPeriod = 100_000      // 100ms is the default of docker
-	skopeoMemory   = "100Mi"
-	skopeoCPU      = "200m"
-)
-
-var (
-	semBuild  = semaphore.NewWeighted(1)
-	semSkopeo = semaphore.NewWeighted(5)
+	apiVersion = "1.40"
 )
 
 // Service runs the wedding server.
 type Service struct {
-	router           http.Handler
-	objectStore      *ObjectStore
-	namespace        string
-	kubernetesClient *kubernetes.Clientset
+	router       http.Handler
+	contexts     ContextStore
+	settings     *settings
+	builds       *scheduler
+	skopeoJobs   *scheduler
+	detached     *detachedBuilds
+	inflight     *inflight
+	copyEngine   string
+	targets      []*target
+	backoffLimit int32
+	jobTTL       time.Duration
+	podTemplates PodTemplates
+	stop         chan struct{}
 }
 
 // NewService creates a new service server and initiates the routes.
-func NewService(gitHash, gitRef string, objectStore *ObjectStore, kubernetesClient *kubernetes.Clientset, namespace string) *Service {
+// Build contexts are kept in the context store, jobs run on the given targets.
+func NewService(gitHash, gitRef string, cfg Config, contexts ContextStore, targets []Target, copyEngine string, backoffLimit int32, jobTTL time.Duration, podTemplates PodTemplates) *Service {
+	stop := make(chan struct{})
+
+	watched := []*target{}
+	for _, t := range targets {
+		watched = append(watched, newTarget(t, stop))
+	}
+
 	srv := &Service{
-		objectStore:      objectStore,
-		namespace:        namespace,
-		kubernetesClient: kubernetesClient,
+		contexts:     contexts,
+		settings:     newSettings(cfg),
+		builds:       newScheduler(cfg.MaxBuilds),
+		skopeoJobs:   newScheduler(cfg.MaxSkopeoJobs),
+		detached:     newDetachedBuilds(),
+		inflight:     newInflight(),
+		copyEngine:   copyEngine,
+		targets:      watched,
+		backoffLimit: backoffLimit,
+		jobTTL:       jobTTL,
+		podTemplates: podTemplates,
+		stop:         stop,
 	}
 
 	srv.routes(gitHash, gitRef)
@@ -51,6 +60,11 @@ func NewService(gitHash, gitRef string, objectStore *ObjectStore, kubernetesClie
 	return srv
 }
 
+// Close stops watching kubernetes resources.
+func (s *Service) Close() {
+	close(s.stop)
+}
+
 func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.router.ServeHTTP(w, r)
 }
@@ -73,6 +87,12 @@ func (s *Service) routes(gitHash, gitRef string) {
 	router.HandleFunc("/{apiVersion}/images/json", imagesJSON).Methods(http.MethodGet)
 	router.HandleFunc("/{apiVersion}/build/prune", buildPrune).Methods(http.MethodPost)
 
+	local, ok := s.contexts.(*LocalContexts)
+	if ok {
+		router.HandleFunc(localContextRoute+"{token}", local.serveList).Methods(http.MethodGet)
+		router.HandleFunc(localContextRoute+"{token}/context", local.serveContext).Methods(http.MethodGet)
+	}
+
 	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotImplemented)
 		w.Write([]byte("This function is not supported by wedding."))
@@ -1,13 +1,10 @@
 package wedding
 
 import (
-	"bytes"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"regexp"
-	"strings"
 
 	"github.com/gorilla/mux"
 )
@@ -16,35 +13,35 @@ func (s Service) tagImage(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	args := r.URL.Query()
 
-	from := fmt.Sprintf("wedding-registry:5000/digests@%s", vars["name"])
-	if !strings.HasPrefix(vars["name"], "sha256:") {
-		// from = fmt.Sprintf("wedding-registry:5000/images/%s", url.PathEscape(escapePort(vars["name"])))
-		from = fmt.Sprintf("wedding-registry:5000/images/%s", escapePort(vars["name"]))
-	}
-
 	tag := args.Get("tag")
 	if tag == "" {
 		tag = "latest"
 	}
 
-	to := fmt.Sprintf(
-		"wedding-registry:5000/images/%s",
-		escapePort(fmt.Sprintf("%s:%s", args.Get("repo"), tag)),
-	)
+	toRepo, _ := localImage(args.Get("repo"))
 
-	script := fmt.Sprintf(`skopeo copy --retry-times 3 --src-tls-verify=false --dest-tls-verify=false docker://%s docker://%s`, from, to)
+	fromRepo, m, err := s.lookupImage(r.Context(), vars["name"])
+	if msg, ok := imageNotFound(err, vars["name"]); ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(msg))
+		return
+	}
+	if err != nil {
+		log.Printf("execute tag: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("look up image: %v", err)))
+		return
+	}
 
-	o := &bytes.Buffer{}
-	err := s.runSkopeoPod(r.Context(), o, "tag", script, "")
+	err = s.localRegistry().copyManifest(r.Context(), fromRepo, toRepo, tag, m)
 	if err != nil {
 		log.Printf("execute tag: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
-		io.Copy(w, o)
+		w.Write([]byte(fmt.Sprintf("tag image: %v", err)))
 		return
 	}
 
 	w.WriteHeader(http.StatusCreated)
-	io.Copy(w, o)
 }
 
 func escapePort(in string) string {
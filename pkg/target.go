@@ -0,0 +1,209 @@
+package wedding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	targetSelectorHeader = "X-Wedding-Target-Selector"
+
+	// unreachableBackoff is the time an unreachable target is only tried
+	// after all reachable ones.
+	unreachableBackoff = 30 * time.Second
+)
+
+var errTargetUnreachable = errors.New("target unreachable")
+
+// Target is a cluster and namespace jobs run in.
+// Requests are only sent to targets accepting their platform, tenant and target selector,
+// empty lists accept every value.
+type Target struct {
+	Name       string            `json:"name"`
+	Kubeconfig string            `json:"kubeconfig"`
+	Context    string            `json:"context"`
+	Namespace  string            `json:"namespace"`
+	Platforms  []string          `json:"platforms"`
+	Tenants    []string          `json:"tenants"`
+	Labels     map[string]string `json:"labels"`
+
+	Client kubernetes.Interface `json:"-"`
+}
+
+// LoadTargets reads the execution targets from a YAML or JSON file.
+func LoadTargets(path string) ([]Target, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read targets: %v", err)
+	}
+
+	file := struct {
+		Targets []Target `json:"targets"`
+	}{}
+
+	err = yaml.UnmarshalStrict(b, &file)
+	if err != nil {
+		return nil, fmt.Errorf("decode targets %s: %v", path, err)
+	}
+
+	if len(file.Targets) == 0 {
+		return nil, fmt.Errorf("targets %s: no target defined", path)
+	}
+
+	names := map[string]bool{}
+	for _, t := range file.Targets {
+		if t.Name == "" {
+			return nil, fmt.Errorf("targets %s: target without name", path)
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("targets %s: target %s is defined twice", path, t.Name)
+		}
+		names[t.Name] = true
+	}
+
+	return file.Targets, nil
+}
+
+// target is an execution target with the jobs watched and running on it.
+type target struct {
+	Target
+	jobs *jobWatcher
+
+	mu          sync.Mutex
+	running     int
+	unreachable time.Time
+}
+
+func newTarget(t Target, stop <-chan struct{}) *target {
+	return &target{
+		Target: t,
+		jobs:   newJobWatcher(t.Client, t.Namespace, stop),
+	}
+}
+
+// accepts checks the platform, tenant and target selector of the operation.
+// Operations without platform only run on targets accepting every platform,
+// the architecture of an image must not depend on the load of the targets.
+func (t *target) accepts(op operation, selector labels.Selector) bool {
+	if len(t.Platforms) != 0 && !containsFold(t.Platforms, op.platform) {
+		return false
+	}
+
+	if len(t.Tenants) != 0 && !containsFold(t.Tenants, op.tenant) {
+		return false
+	}
+
+	return selector.Matches(labels.Set(t.Labels))
+}
+
+func (t *target) acquire() func() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.running++
+
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		t.running--
+	}
+}
+
+func (t *target) markUnreachable() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.unreachable = time.Now()
+}
+
+// load returns the number of running jobs and whether the target failed recently.
+func (t *target) load() (int, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.running, time.Since(t.unreachable) < unreachableBackoff
+}
+
+// selectTargets returns the targets accepting the operation in the order they
+// should be tried. Reachable targets go first, the least loaded one leading.
+// Operations without platform use the default platform of the config.
+func (s Service) selectTargets(op operation) ([]*target, error) {
+	if op.platform == "" {
+		op.platform = s.config().DefaultPlatform
+	}
+
+	selector, err := labels.Parse(op.targetSelector)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %v", targetSelectorHeader, err)
+	}
+
+	candidates := []*target{}
+	running := map[*target]int{}
+	unreachable := map[*target]bool{}
+
+	for _, t := range s.targets {
+		if !t.accepts(op, selector) {
+			continue
+		}
+
+		candidates = append(candidates, t)
+		running[t], unreachable[t] = t.load()
+	}
+
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no target accepts platform %q, tenant %q and selector %q", op.platform, op.tenant, op.targetSelector)
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+
+		if unreachable[a] != unreachable[b] {
+			return !unreachable[a]
+		}
+
+		return running[a] < running[b]
+	})
+
+	return candidates, nil
+}
+
+// isUnreachable tells errors of the connection to the api server apart from
+// errors returned by the api server and local failures.
+// Requests canceled by the client do not fail the target.
+func isUnreachable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	if apierrors.IsServiceUnavailable(err) || apierrors.IsServerTimeout(err) || apierrors.IsTimeout(err) {
+		return true
+	}
+
+	var urlErr *url.Error
+	var netErr net.Error
+	return errors.As(err, &urlErr) || errors.As(err, &netErr)
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,105 @@
+package wedding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func Test_selectTargets(t *testing.T) {
+	amd64 := &target{Target: Target{Name: "amd64", Platforms: []string{"linux/amd64"}, Labels: map[string]string{"quota": "large"}}}
+	amd64Small := &target{Target: Target{Name: "amd64-small", Platforms: []string{"linux/amd64"}}}
+	arm64 := &target{Target: Target{Name: "arm64", Platforms: []string{"linux/arm64"}}}
+	teamA := &target{Target: Target{Name: "team-a", Tenants: []string{"team-a"}}}
+
+	amd64.acquire()
+	amd64.acquire()
+	amd64Small.acquire()
+
+	s := Service{
+		targets:  []*target{amd64, amd64Small, arm64, teamA},
+		settings: newSettings(DefaultConfig()),
+	}
+
+	withDefault := DefaultConfig()
+	withDefault.DefaultPlatform = "linux/arm64"
+	d := Service{targets: s.targets, settings: newSettings(withDefault)}
+
+	tests := []struct {
+		name    string
+		s       Service
+		op      operation
+		want    []string
+		wantErr bool
+	}{
+		{name: "least loaded", s: s, op: operation{tenant: "ci", platform: "linux/amd64"}, want: []string{"amd64-small", "amd64"}},
+		{name: "platform", s: s, op: operation{tenant: "ci", platform: "linux/arm64"}, want: []string{"arm64"}},
+		{name: "no platform", s: s, op: operation{tenant: "ci"}, wantErr: true},
+		{name: "default platform", s: d, op: operation{tenant: "ci"}, want: []string{"arm64"}},
+		{name: "tenant", s: s, op: operation{tenant: "team-a"}, want: []string{"team-a"}},
+		{name: "tenant with platform", s: s, op: operation{tenant: "team-a", platform: "linux/arm64"}, want: []string{"arm64", "team-a"}},
+		{name: "selector", s: s, op: operation{tenant: "ci", platform: "linux/amd64", targetSelector: "quota=large"}, want: []string{"amd64"}},
+		{name: "no target", s: s, op: operation{tenant: "ci", platform: "linux/s390x", targetSelector: "quota=large"}, wantErr: true},
+		{name: "invalid selector", s: s, op: operation{tenant: "ci", targetSelector: "quota=="}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targets, err := tt.s.selectTargets(tt.op)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectTargets() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var got []string
+			for _, target := range targets {
+				got = append(got, target.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("selectTargets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	amd64Small.markUnreachable()
+
+	targets, err := s.selectTargets(operation{tenant: "ci", platform: "linux/amd64"})
+	if err != nil {
+		t.Fatalf("selectTargets() error = %v", err)
+	}
+	if last := targets[len(targets)-1]; last != amd64Small {
+		t.Errorf("selectTargets() tries %s last, want the unreachable target amd64-small", last.Name)
+	}
+}
+
+func Test_isUnreachable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "connection refused", err: &url.Error{Op: "Post", URL: "https://10.0.0.1:6443", Err: errors.New("connect: connection refused")}, want: true},
+		{name: "unavailable", err: apierrors.NewServiceUnavailable("overloaded"), want: true},
+		{name: "forbidden", err: apierrors.NewForbidden(schema.GroupResource{Resource: "jobs"}, "", errors.New("quota")), want: false},
+		{name: "exists", err: apierrors.NewAlreadyExists(schema.GroupResource{Resource: "secrets"}, "wedding-docker-config-a"), want: false},
+		{name: "dial", err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("no route to host")}, want: true},
+		{name: "server timeout", err: apierrors.NewServerTimeout(schema.GroupResource{Resource: "jobs"}, "create", 1), want: true},
+		{name: "timeout", err: apierrors.NewTimeoutError("request did not complete", 1), want: true},
+		{name: "canceled", err: context.Canceled, want: false},
+		{name: "canceled request", err: &url.Error{Op: "Post", URL: "https://10.0.0.1:6443", Err: context.Canceled}, want: false},
+		{name: "encode job", err: fmt.Errorf("encode job: %v", errors.New("json: unsupported value")), want: false},
+		{name: "pod template", err: errors.New("merge pod template: containers: invalid"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isUnreachable(tt.err); got != tt.want {
+				t.Errorf("isUnreachable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
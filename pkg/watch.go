@@ -0,0 +1,230 @@
+package wedding
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listersbatchv1 "k8s.io/client-go/listers/batch/v1"
+	listerscorev1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	eventBuffer = 32
+
+	jobNameLabel = "job-name"
+)
+
+// jobWatcher watches wedding jobs, their pods and events with shared informers
+// and notifies the requests waiting for them.
+type jobWatcher struct {
+	namespace     string
+	mu            sync.Mutex
+	subscriptions map[string]*jobSubscription
+	jobs          listersbatchv1.JobLister
+	pods          listerscorev1.PodLister
+}
+
+// jobSubscription is notified about changes of a job and its pods.
+// The current state is read from the watcher.
+type jobSubscription struct {
+	name    string
+	changed chan struct{}
+	events  chan *corev1.Event
+}
+
+func newJobWatcher(kubernetesClient kubernetes.Interface, namespace string, stop <-chan struct{}) *jobWatcher {
+	weddingInformers := informers.NewSharedInformerFactoryWithOptions(
+		kubernetesClient,
+		0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.LabelSelector = "app=wedding"
+		}),
+	)
+
+	eventInformers := informers.NewSharedInformerFactoryWithOptions(
+		kubernetesClient,
+		0,
+		informers.WithNamespace(namespace),
+	)
+
+	jobInformer := weddingInformers.Batch().V1().Jobs()
+	podInformer := weddingInformers.Core().V1().Pods()
+	eventInformer := eventInformers.Core().V1().Events()
+
+	w := &jobWatcher{
+		namespace:     namespace,
+		subscriptions: map[string]*jobSubscription{},
+		jobs:          jobInformer.Lister(),
+		pods:          podInformer.Lister(),
+	}
+
+	notify := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			w.notify(obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			w.notify(newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			w.notify(obj)
+		},
+	}
+
+	jobInformer.Informer().AddEventHandler(notify)
+	podInformer.Informer().AddEventHandler(notify)
+
+	eventInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			w.dispatchEvent(obj)
+		},
+	})
+
+	weddingInformers.Start(stop)
+	eventInformers.Start(stop)
+
+	go func() {
+		for informer, synced := range weddingInformers.WaitForCacheSync(stop) {
+			if !synced {
+				log.Printf("job watcher: cache for %v not synced", informer)
+			}
+		}
+	}()
+
+	return w
+}
+
+// subscribe starts notifying about changes of the job and its pods.
+func (w *jobWatcher) subscribe(name string) *jobSubscription {
+	sub := &jobSubscription{
+		name:    name,
+		changed: make(chan struct{}, 1),
+		events:  make(chan *corev1.Event, eventBuffer),
+	}
+
+	w.mu.Lock()
+	w.subscriptions[name] = sub
+	w.mu.Unlock()
+
+	// the job might have been cached before the subscription existed
+	sub.notify()
+
+	return sub
+}
+
+func (w *jobWatcher) unsubscribe(sub *jobSubscription) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.subscriptions[sub.name] == sub {
+		delete(w.subscriptions, sub.name)
+	}
+}
+
+func (w *jobWatcher) subscription(name string) (*jobSubscription, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	sub, ok := w.subscriptions[name]
+	return sub, ok
+}
+
+// job returns the cached state of a job.
+func (w *jobWatcher) job(name string) (*batchv1.Job, error) {
+	return w.jobs.Jobs(w.namespace).Get(name)
+}
+
+// jobPods returns the cached pods of a job, oldest first.
+func (w *jobWatcher) jobPods(name string) ([]*corev1.Pod, error) {
+	pods, err := w.pods.Pods(w.namespace).List(labels.SelectorFromSet(labels.Set{jobNameLabel: name}))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(pods, func(i, j int) bool {
+		return pods[i].CreationTimestamp.Before(&pods[j].CreationTimestamp)
+	})
+
+	return pods, nil
+}
+
+// pod returns the cached state of a pod.
+func (w *jobWatcher) pod(name string) (*corev1.Pod, error) {
+	return w.pods.Pods(w.namespace).Get(name)
+}
+
+func (w *jobWatcher) notify(obj interface{}) {
+	name := ""
+
+	switch o := obj.(type) {
+	case *batchv1.Job:
+		name = o.Name
+	case *corev1.Pod:
+		name = o.Labels[jobNameLabel]
+	default:
+		return
+	}
+
+	sub, ok := w.subscription(name)
+	if !ok {
+		return
+	}
+
+	sub.notify()
+}
+
+func (w *jobWatcher) dispatchEvent(obj interface{}) {
+	event, ok := obj.(*corev1.Event)
+	if !ok {
+		return
+	}
+
+	name := ""
+
+	switch event.InvolvedObject.Kind {
+	case "Job":
+		name = event.InvolvedObject.Name
+	case "Pod":
+		pod, err := w.pod(event.InvolvedObject.Name)
+		if err != nil {
+			return
+		}
+		name = pod.Labels[jobNameLabel]
+	default:
+		return
+	}
+
+	sub, ok := w.subscription(name)
+	if !ok {
+		return
+	}
+
+	select {
+	case sub.events <- event:
+	default:
+		// events are informative only, drop them if the request does not keep up
+	}
+}
+
+func (sub *jobSubscription) notify() {
+	select {
+	case sub.changed <- struct{}{}:
+	default:
+	}
+}
+
+func formatEvent(event *corev1.Event) string {
+	return fmt.Sprintf("%s %s: %s\n", event.InvolvedObject.Name, event.Reason, event.Message)
+}
@@ -0,0 +1,102 @@
+package wedding
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_jobWatcher(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	w := newJobWatcher(client, "default", stop)
+
+	sub := w.subscribe("wedding-build-a")
+	defer w.unsubscribe(sub)
+
+	awaitChange := func(what string) {
+		t.Helper()
+
+		select {
+		case <-sub.changed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s not notified", what)
+		}
+	}
+
+	// drain the notification sent on subscribe
+	awaitChange("subscription")
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "wedding-build-a",
+			Namespace: "default",
+			Labels:    map[string]string{"app": "wedding"},
+		},
+	}
+
+	_, err := client.BatchV1().Jobs("default").Create(ctx, job, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("create job: %v", err)
+	}
+
+	awaitChange("job creation")
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "wedding-build-a-x7k2p",
+			Namespace: "default",
+			Labels:    map[string]string{"app": "wedding", jobNameLabel: "wedding-build-a"},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+
+	_, err = client.CoreV1().Pods("default").Create(ctx, pod, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("create pod: %v", err)
+	}
+
+	awaitChange("pod creation")
+
+	pods, err := w.jobPods("wedding-build-a")
+	if err != nil {
+		t.Fatalf("list job pods: %v", err)
+	}
+	if len(pods) != 1 || pods[0].Status.Phase != corev1.PodRunning {
+		t.Errorf("jobPods() = %v, want the running pod", pods)
+	}
+
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "wedding-build-a-x7k2p.1",
+			Namespace: "default",
+		},
+		InvolvedObject: corev1.ObjectReference{Kind: "Pod", Name: "wedding-build-a-x7k2p"},
+		Reason:         "Pulled",
+		Message:        `Container image "moby/buildkit:v0.9.3-rootless" already present on machine`,
+	}
+
+	_, err = client.CoreV1().Events("default").Create(ctx, event, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("create event: %v", err)
+	}
+
+	select {
+	case got := <-sub.events:
+		want := "wedding-build-a-x7k2p Pulled: Container image \"moby/buildkit:v0.9.3-rootless\" already present on machine\n"
+		if formatEvent(got) != want {
+			t.Errorf("formatEvent() = %v, want %v", formatEvent(got), want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("event not dispatched")
+	}
+}